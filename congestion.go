@@ -0,0 +1,387 @@
+package kcp
+
+import "math"
+
+// CongestionController decides how many segments a KCP connection keeps in
+// flight, from the acknowledgements, losses and round trip times KCP reports.
+// Its methods are called with the connection locked, a controller must not be
+// shared between connections.
+type CongestionController interface {
+	// OnAck is called when acknowledgements advanced the send window,
+	// acked segments left the send buffer since the previous call, and rtt
+	// is the latest round trip time sample in milliseconds, -1 if none
+	OnAck(state CongestionState, acked uint32, rtt int32)
+
+	// OnLoss is called after a flush retransmitted segments, fast of them
+	// on duplicate acknowledgements, timeout of them once their
+	// retransmission timeout expired
+	OnLoss(state CongestionState, fast, timeout uint32)
+
+	// Window returns the congestion window in segments, at least 1
+	Window() uint32
+}
+
+// CongestionState describes a KCP connection to its CongestionController
+type CongestionState struct {
+	Now          uint32 // current time in milliseconds
+	MSS          uint32 // maximum segment size
+	Inflight     uint32 // segments sent and not acknowledged yet
+	SendWindow   uint32 // the smaller of the send window and the peer's receive window
+	RemoteWindow uint32 // the peer's receive window
+	FastResend   uint32 // duplicate acknowledgements triggering a fast retransmit, 0xffffffff if disabled
+	SRTT         int32  // smoothed round trip time in milliseconds
+}
+
+// renoController is the classic KCP congestion control, slow start and
+// congestion avoidance after RFC 5681, with rate halving on fast retransmits
+type renoController struct {
+	cwnd, ssthresh, incr uint32
+}
+
+// NewRenoController returns the default congestion control of KCP
+func NewRenoController() CongestionController {
+	return &renoController{cwnd: 1, ssthresh: IKCP_THRESH_INIT}
+}
+
+func (r *renoController) OnAck(s CongestionState, acked uint32, rtt int32) {
+	if r.cwnd >= s.RemoteWindow {
+		return
+	}
+	mss := s.MSS
+	if r.cwnd < r.ssthresh {
+		r.cwnd++
+		r.incr += mss
+	} else {
+		if r.incr < mss {
+			r.incr = mss
+		}
+		r.incr += (mss*mss)/r.incr + (mss / 16)
+		if (r.cwnd+1)*mss <= r.incr {
+			r.cwnd++
+		}
+	}
+	if r.cwnd > s.RemoteWindow {
+		r.cwnd = s.RemoteWindow
+		r.incr = s.RemoteWindow * mss
+	}
+}
+
+func (r *renoController) OnLoss(s CongestionState, fast, timeout uint32) {
+	window := _imin_(r.cwnd, s.SendWindow)
+
+	// rate halving, https://tools.ietf.org/html/rfc6937
+	if fast > 0 {
+		r.ssthresh = s.Inflight / 2
+		if r.ssthresh < IKCP_THRESH_MIN {
+			r.ssthresh = IKCP_THRESH_MIN
+		}
+		r.cwnd = r.ssthresh + s.FastResend
+		r.incr = r.cwnd * s.MSS
+	}
+
+	// congestion control, https://tools.ietf.org/html/rfc5681
+	if timeout > 0 {
+		r.ssthresh = window / 2
+		if r.ssthresh < IKCP_THRESH_MIN {
+			r.ssthresh = IKCP_THRESH_MIN
+		}
+		r.cwnd = 1
+		r.incr = s.MSS
+	}
+
+	if r.cwnd < 1 {
+		r.cwnd = 1
+		r.incr = s.MSS
+	}
+}
+
+func (r *renoController) Window() uint32 { return r.cwnd }
+
+const (
+	// CUBIC constants, https://tools.ietf.org/html/rfc8312
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// cubicController grows the window along a cubic function of the time since
+// the last reduction, plateauing around the window the loss happened at, so
+// it regains the window quickly on long fat paths
+type cubicController struct {
+	cwnd, ssthresh float64
+	wMax           float64 // window before the last reduction
+	k              float64 // seconds the cubic function takes to reach wMax
+	origin         float64 // window the cubic function plateaus at
+	wEst           float64 // window of a Reno flow, the floor of CUBIC's
+	epoch          uint32  // start of the current congestion avoidance epoch, 0 if none
+	recovery       uint32  // end of the fast recovery, losses until then are the same event
+}
+
+// NewCUBICController returns a CUBIC congestion control (RFC 8312)
+func NewCUBICController() CongestionController {
+	return &cubicController{cwnd: 1, ssthresh: math.MaxUint32}
+}
+
+func (c *cubicController) OnAck(s CongestionState, acked uint32, rtt int32) {
+	if c.cwnd < c.ssthresh {
+		c.cwnd += float64(acked)
+	} else {
+		if c.epoch == 0 {
+			c.epoch = s.Now
+			if c.epoch == 0 {
+				c.epoch = 1
+			}
+			c.k, c.origin = 0, c.cwnd
+			if c.cwnd < c.wMax {
+				c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+				c.origin = c.wMax
+			}
+			c.wEst = c.cwnd
+		}
+
+		// the window one RTT from now
+		t := float64(_itimediff(s.Now, c.epoch)+s.SRTT) / 1000
+		target := c.origin + cubicC*math.Pow(t-c.k, 3)
+		if target > c.cwnd {
+			c.cwnd += (target - c.cwnd) / c.cwnd * float64(acked)
+		} else {
+			c.cwnd += 0.01 * float64(acked) / c.cwnd
+		}
+
+		// TCP friendly region
+		c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(acked) / c.cwnd
+		if c.wEst > c.cwnd {
+			c.cwnd = c.wEst
+		}
+	}
+	if c.cwnd > float64(s.RemoteWindow) {
+		c.cwnd = float64(s.RemoteWindow)
+	}
+}
+
+func (c *cubicController) OnLoss(s CongestionState, fast, timeout uint32) {
+	if timeout > 0 {
+		c.wMax = c.cwnd
+		c.ssthresh = math.Max(c.cwnd*cubicBeta, IKCP_THRESH_MIN)
+		c.cwnd = 1
+		c.epoch = 0
+		return
+	}
+	if _itimediff(s.Now, c.recovery) < 0 {
+		return
+	}
+
+	// fast convergence releases bandwidth to newer flows
+	if c.cwnd < c.wMax {
+		c.wMax = c.cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+	c.cwnd = math.Max(c.cwnd*cubicBeta, IKCP_THRESH_MIN)
+	c.ssthresh = c.cwnd
+	c.epoch = 0
+	c.recovery = s.Now + uint32(s.SRTT)
+}
+
+func (c *cubicController) Window() uint32 {
+	if c.cwnd < 1 {
+		return 1
+	}
+	return uint32(c.cwnd)
+}
+
+const (
+	// BBR constants, https://tools.ietf.org/html/draft-cardwell-iccrg-bbr-congestion-control
+	bbrHighGain         = 2.885 // 2/ln(2), doubles the delivery rate every round
+	bbrBwRounds         = 10    // rounds the bandwidth max filter spans
+	bbrMinRTTWindow     = 10000 // ms the min RTT estimate stays valid
+	bbrProbeRTTDuration = 200   // ms spent probing for the min RTT
+	bbrMinWindow        = 4     // segments
+	bbrFullBwThreshold  = 1.25  // growth of the bandwidth meaning the pipe isn't full yet
+	bbrFullBwRounds     = 3     // rounds without that growth meaning the pipe is full
+)
+
+// gains of the ProbeBW cycle, probing for more bandwidth then draining the
+// queue it built
+var bbrCycleGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// modes of bbrController
+const (
+	bbrStartup = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+// bbrController models the path by its bottleneck bandwidth and its min RTT,
+// and keeps their product in flight, regardless of losses, which on lossy
+// paths aren't a sign of congestion. KCP paces, when it does, at the window
+// per RTT, so the gains BBR paces with apply to the window.
+type bbrController struct {
+	mode int
+	cwnd uint32
+
+	// bottleneck bandwidth in segments per millisecond, the max of the
+	// delivery rates of the last rounds
+	bw      float64
+	samples [bbrBwRounds]float64
+	rounds  int
+
+	// min RTT in milliseconds, and when it was measured
+	minRTT      int32
+	minRTTStamp uint32
+
+	// delivery rate sampling, once per round trip
+	delivered      uint32 // segments acknowledged so far
+	roundStart     uint32 // start time of the round
+	roundDelivered uint32 // delivered at the start of the round
+	roundEnd       uint32 // delivered ending the round
+
+	fullBw      float64 // bandwidth at the last growth in startup
+	fullBwCount int
+	cycleIndex  int
+	cycleStamp  uint32
+	probeRTTEnd uint32
+}
+
+// NewBBRController returns a BBR congestion control, which keeps throughput
+// up on paths with random losses
+func NewBBRController() CongestionController {
+	return &bbrController{cwnd: bbrMinWindow, minRTT: -1}
+}
+
+func (b *bbrController) OnAck(s CongestionState, acked uint32, rtt int32) {
+	b.delivered += acked
+	if rtt >= 0 {
+		if rtt < 1 {
+			rtt = 1
+		}
+		if b.minRTT < 0 || rtt <= b.minRTT || _itimediff(s.Now, b.minRTTStamp) > bbrMinRTTWindow {
+			b.minRTT, b.minRTTStamp = rtt, s.Now
+		}
+	}
+
+	if b.roundStart == 0 {
+		b.startRound(s)
+		return
+	}
+
+	if _itimediff(b.delivered, b.roundEnd) >= 0 {
+		if elapsed := _itimediff(s.Now, b.roundStart); elapsed > 0 {
+			b.samples[b.rounds%bbrBwRounds] = float64(b.delivered-b.roundDelivered) / float64(elapsed)
+			b.rounds++
+			b.bw = 0
+			for _, sample := range b.samples {
+				b.bw = math.Max(b.bw, sample)
+			}
+			b.roundEnded(s)
+		}
+		b.startRound(s)
+	}
+
+	switch b.mode {
+	case bbrDrain:
+		if float64(s.Inflight) <= math.Max(b.bdp(), bbrMinWindow) {
+			b.enterProbeBW(s)
+		}
+	case bbrProbeBW:
+		if _itimediff(s.Now, b.cycleStamp) > b.minRTT {
+			b.cycleIndex = (b.cycleIndex + 1) % len(bbrCycleGains)
+			b.cycleStamp = s.Now
+		}
+	case bbrProbeRTT:
+		if _itimediff(s.Now, b.probeRTTEnd) >= 0 {
+			b.minRTTStamp = s.Now
+			if b.fullBwCount >= bbrFullBwRounds {
+				b.enterProbeBW(s)
+			} else {
+				b.mode = bbrStartup
+			}
+		}
+	}
+
+	// the min RTT is only seen with the queue drained
+	if b.mode != bbrProbeRTT && b.minRTT >= 0 && _itimediff(s.Now, b.minRTTStamp) > bbrMinRTTWindow {
+		b.mode = bbrProbeRTT
+		b.probeRTTEnd = s.Now + bbrProbeRTTDuration
+	}
+
+	// grow like slow start until the pipe is full, and towards the target
+	// after, without ever growing past it
+	target := b.target()
+	if b.fullBwCount >= bbrFullBwRounds {
+		b.cwnd = _imin_(b.cwnd+acked, target)
+	} else if b.cwnd < target || target == 0 {
+		b.cwnd += acked
+	}
+	if b.cwnd > s.RemoteWindow {
+		b.cwnd = s.RemoteWindow
+	}
+	if b.cwnd < bbrMinWindow {
+		b.cwnd = bbrMinWindow
+	}
+}
+
+// startRound starts a round trip, which ends once the segments in flight now
+// are acknowledged
+func (b *bbrController) startRound(s CongestionState) {
+	b.roundStart = s.Now
+	if b.roundStart == 0 {
+		b.roundStart = 1
+	}
+	b.roundDelivered = b.delivered
+	b.roundEnd = b.delivered + s.Inflight
+	if s.Inflight == 0 {
+		b.roundEnd++
+	}
+}
+
+// roundEnded leaves startup once the bandwidth stopped growing
+func (b *bbrController) roundEnded(s CongestionState) {
+	if b.mode != bbrStartup {
+		return
+	}
+	if b.bw >= b.fullBw*bbrFullBwThreshold {
+		b.fullBw = b.bw
+		b.fullBwCount = 0
+		return
+	}
+	if b.fullBwCount++; b.fullBwCount >= bbrFullBwRounds {
+		b.mode = bbrDrain
+	}
+}
+
+func (b *bbrController) enterProbeBW(s CongestionState) {
+	b.mode = bbrProbeBW
+	b.cycleIndex = 0
+	b.cycleStamp = s.Now
+}
+
+// bdp returns the bandwidth delay product in segments
+func (b *bbrController) bdp() float64 {
+	if b.minRTT < 0 {
+		return 0
+	}
+	return b.bw * float64(b.minRTT)
+}
+
+// OnLoss ignores losses, the model already tells how much the path carries
+func (b *bbrController) OnLoss(s CongestionState, fast, timeout uint32) {}
+
+func (b *bbrController) Window() uint32 {
+	if b.mode == bbrProbeRTT {
+		return _imin_(b.cwnd, bbrMinWindow)
+	}
+	return b.cwnd
+}
+
+// target returns the window the model calls for, 0 without an estimate yet
+func (b *bbrController) target() uint32 {
+	gain := 1.0
+	switch b.mode {
+	case bbrStartup:
+		gain = bbrHighGain
+	case bbrProbeBW:
+		gain = bbrCycleGains[b.cycleIndex]
+	}
+	return uint32(gain * b.bdp())
+}
@@ -0,0 +1,190 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestRenoController(t *testing.T) {
+	cc := NewRenoController()
+	s := CongestionState{MSS: 1376, RemoteWindow: 128, SendWindow: 128, FastResend: 2}
+	if cc.Window() != 1 {
+		t.Fatal("initial window", cc.Window())
+	}
+
+	// slow start up to ssthresh, then congestion avoidance
+	for i := 0; i < IKCP_THRESH_INIT-1; i++ {
+		cc.OnAck(s, 1, 100)
+	}
+	if cc.Window() != IKCP_THRESH_INIT {
+		t.Fatal("slow start window", cc.Window())
+	}
+	cc.OnAck(s, 1, 100)
+	if cc.Window() != IKCP_THRESH_INIT {
+		t.Fatal("congestion avoidance grew by a segment per ack", cc.Window())
+	}
+
+	s.Inflight = 20
+	cc.OnLoss(s, 1, 0)
+	if w := cc.Window(); w != 20/2+s.FastResend {
+		t.Fatal("rate halving window", w)
+	}
+	cc.OnLoss(s, 0, 1)
+	if cc.Window() != 1 {
+		t.Fatal("timeout window", cc.Window())
+	}
+
+	// never beyond the peer's window
+	s.RemoteWindow = 4
+	for i := 0; i < 10; i++ {
+		cc.OnAck(s, 1, 100)
+	}
+	if cc.Window() != 4 {
+		t.Fatal("window beyond the peer's", cc.Window())
+	}
+}
+
+func TestCUBICController(t *testing.T) {
+	cc := NewCUBICController()
+	s := CongestionState{Now: 1000, MSS: 1376, RemoteWindow: 1024, SendWindow: 1024, SRTT: 50}
+	for cc.Window() < 100 {
+		cc.OnAck(s, 1, 50)
+	}
+
+	cc.OnLoss(s, 1, 0)
+	if w := cc.Window(); w != uint32(100*cubicBeta) {
+		t.Fatal("window after loss", w)
+	}
+	// the same loss event doesn't reduce the window twice
+	cc.OnLoss(s, 1, 0)
+	if w := cc.Window(); w != uint32(100*cubicBeta) {
+		t.Fatal("window reduced twice in a recovery", w)
+	}
+
+	// regrows towards the window of the loss, then beyond it
+	var w uint32
+	for i := 0; i < 100; i++ {
+		s.Now += 50
+		for j := uint32(0); j < cc.Window(); j++ {
+			cc.OnAck(s, 1, 50)
+		}
+		if w = cc.Window(); w >= 100 {
+			break
+		}
+	}
+	if w < 100 {
+		t.Fatal("window didn't regrow", w)
+	}
+	for i := 0; i < 10; i++ {
+		s.Now += 1000
+		cc.OnAck(s, 1, 50)
+	}
+	if cc.Window() <= w {
+		t.Fatal("window didn't probe beyond the loss", cc.Window())
+	}
+}
+
+func TestBBRController(t *testing.T) {
+	// a path carrying a segment per millisecond with a 100ms RTT
+	const rate, rtt = 1, 100
+	cc := NewBBRController()
+	s := CongestionState{Now: 1000, MSS: 1376, RemoteWindow: 1024, SendWindow: 1024}
+
+	var queue []uint32 // delivery times of the segments in flight
+	for s.Now < 11000 {
+		for uint32(len(queue)) < cc.Window() {
+			at := s.Now + rtt
+			if n := len(queue); n > 0 && queue[n-1]+1/rate > at {
+				at = queue[n-1] + 1/rate
+			}
+			queue = append(queue, at)
+		}
+		s.Inflight = uint32(len(queue))
+		acked := 0
+		for acked < len(queue) && queue[acked] <= s.Now {
+			acked++
+		}
+		if acked > 0 {
+			queue = queue[acked:]
+			s.Inflight = uint32(len(queue))
+			cc.OnAck(s, uint32(acked), rtt)
+		}
+		s.Now++
+	}
+
+	bdp := uint32(rate * rtt)
+	if w := cc.Window(); w < bdp/2 || w > 3*bdp {
+		t.Fatal("window far from the BDP", w)
+	}
+	w := cc.Window()
+	cc.OnLoss(s, 10, 10)
+	if cc.Window() != w {
+		t.Fatal("window reduced by loss", cc.Window())
+	}
+}
+
+func TestCongestionControllers(t *testing.T) {
+	controllers := map[string]func() CongestionController{
+		"reno":  NewRenoController,
+		"cubic": NewCUBICController,
+		"bbr":   NewBBRController,
+	}
+	for name, newcc := range controllers {
+		if n := transfer(newcc(), 256); n != 256 {
+			t.Fatal(name, "delivered", n, "of", 256)
+		}
+	}
+}
+
+// transfer sends count segments over a lossy simulated network with cc, and
+// returns how many arrived in order
+func transfer(cc CongestionController, count int) int {
+	vnet := &LatencySimulator{}
+	vnet.Init(10, 60, 125, 1000)
+	kcp1 := NewKCP(1, func(buf []byte, size int) { vnet.send(0, buf, size) })
+	kcp2 := NewKCP(1, func(buf []byte, size int) { vnet.send(1, buf, size) })
+	kcp1.NoDelay(1, 10, 2, 0)
+	kcp2.NoDelay(1, 10, 2, 0)
+	kcp1.SetCongestionController(cc)
+
+	msg := make([]byte, 512)
+	for i := 0; i < count; i++ {
+		binary.LittleEndian.PutUint32(msg, uint32(i))
+		kcp1.Send(msg)
+	}
+
+	buffer := make([]byte, 2000)
+	next := 0
+	deadline := time.Now().Add(30 * time.Second)
+	for next < count && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		kcp1.Update()
+		kcp2.Update()
+		for {
+			hr := vnet.recv(1, buffer, 2000)
+			if hr < 0 {
+				break
+			}
+			kcp2.Input(buffer[:hr], true, false)
+		}
+		for {
+			hr := vnet.recv(0, buffer, 2000)
+			if hr < 0 {
+				break
+			}
+			kcp1.Input(buffer[:hr], true, false)
+		}
+		for {
+			hr := kcp2.Recv(buffer)
+			if hr < 0 {
+				break
+			}
+			if binary.LittleEndian.Uint32(buffer) != uint32(next) {
+				return next
+			}
+			next++
+		}
+	}
+	return next
+}
@@ -0,0 +1,852 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// ICMP echo header size
+	icmpHeaderSize = 8
+
+	// size of the direction tag prefixing tunnel payloads
+	icmpTagSize = 4
+
+	// maximum size of an inbound ICMP message
+	icmpReadBufferSize = 65536
+
+	// IANA protocol numbers for icmp.ParseMessage
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// icmpFamily holds the IP version specific parameters of an ICMPConn
+type icmpFamily struct {
+	network     string             // network of privileged ICMP sockets
+	ping        string             // network for unprivileged ping sockets
+	wildcard    string             // the local address listening on all interfaces
+	proto       int                // protocol number of ICMP messages
+	filter      string             // pcap filter capturing ICMP messages
+	layer       gopacket.LayerType // IP layer carrying the ICMP messages
+	echoRequest icmp.Type
+	echoReply   icmp.Type
+}
+
+var (
+	icmpv4 = &icmpFamily{"ip4:icmp", "udp4", "0.0.0.0", protocolICMP, "icmp", layers.LayerTypeIPv4, ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply}
+	icmpv6 = &icmpFamily{"ip6:ipv6-icmp", "udp6", "::", protocolIPv6ICMP, "icmp6", layers.LayerTypeIPv6, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply}
+)
+
+// typeNumber returns the numeric value of an ICMP message type of the family
+func (f *icmpFamily) typeNumber(typ icmp.Type) int {
+	switch t := typ.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	}
+	return -1
+}
+
+// icmpFamilyOf returns the ICMP family used to talk to ip, IPv4 if ip is unspecified
+func icmpFamilyOf(ip net.IP) *icmpFamily {
+	if ip == nil || ip.To4() != nil {
+		return icmpv4
+	}
+	return icmpv6
+}
+
+// EchoIDMode selects how the echo identifier of ICMP tunnel packets is chosen
+type EchoIDMode int
+
+const (
+	// EchoIDRandom picks a random identifier for every Dial, listeners accept any identifier
+	EchoIDRandom EchoIDMode = iota
+	// EchoIDFixed uses ICMPTransport.EchoID on both ends
+	EchoIDFixed
+	// EchoIDKeyed derives the identifier from ICMPTransport.EchoIDKey on both ends
+	EchoIDKeyed
+)
+
+// ICMPTransport carries KCP packets in ICMP or ICMPv6 echo messages, clients
+// send echo requests and servers answer with echo replies. The IP version is
+// picked from the address passed to Dial or Listen.
+//
+// Stateful firewalls and NATs only pass echo replies answering an outstanding
+// request, setting Budget makes clients keep that many requests outstanding,
+// empty ones when idle, while servers hold outbound packets back until they
+// can be sent as the reply to one of them. Both ends must agree on it.
+//
+// Listeners with PingReplies set answer echo requests not belonging to the
+// tunnel like an ordinary host would, so the server keeps answering pings once
+// the kernel is told not to with the net.ipv4.icmp_echo_ignore_all sysctl,
+// which keeps it from reflecting tunnel traffic. Leave it unset while the
+// kernel answers, or every ping gets two replies.
+//
+// With Shape set, packets are split into echo messages looking like the ones
+// ping sends, a 56 byte payload starting with a timestamp, and ShapeInterval
+// spaces them out in time. Each message carries a 31 byte chunk of a packet,
+// so sessions send smaller packets, see Overhead. Paced messages wait in a
+// queue, writes never block, and packets are dropped when it's full. Both
+// ends must agree on Shape.
+//
+// Carrier picks other message types for networks filtering echo messages,
+// both ends must agree on it, and listeners only answer pings with CarrierEcho.
+//
+// Clients with Unprivileged set need neither root nor CAP_NET_RAW, they use
+// the unprivileged ping sockets of Linux, for the groups allowed by the
+// net.ipv4.ping_group_range sysctl, and of macOS. The kernel picks the echo
+// identifier and hands the socket only the replies carrying it, so it works
+// with CarrierEcho and EchoIDRandom only.
+//
+// Listeners on multi-homed hosts capture on several interfaces at once, Devs
+// lists them, and answer each client out of the interface and from the local
+// address its packets arrived on.
+type ICMPTransport struct {
+	Dev           string         // the interface pcap captures inbound packets on, empty to pick it from the routing table
+	Devs          []string       // the interfaces to capture on, overriding Dev
+	Capture       CaptureOptions // tuning of the pcap capture
+	EchoIDMode    EchoIDMode     // how the echo identifier is chosen
+	EchoID        uint16         // the identifier for EchoIDFixed
+	EchoIDKey     []byte         // the shared key for EchoIDKeyed
+	Budget        int            // outstanding echo requests in request/reply mode, 0 disables it
+	PingReplies   bool           // listeners answer echo requests not belonging to the tunnel, for kernels ignoring pings
+	PingRateLimit int            // maximum ping replies per second, 0 for no limit
+	Shape         bool           // send packets in ping sized echo messages
+	ShapeInterval time.Duration  // minimum time between echo messages when shaping
+	Carrier       Carrier        // the ICMP messages carrying tunnel packets
+	Unprivileged  bool           // clients send and receive on a ping socket, without pcap
+
+	// Source replaces the capture of inbound packets, to replay captures
+	// from pcap.OpenOffline or pcapgo, or inject crafted packets with a
+	// PacketInjector. The source is left open when the connection closes.
+	Source func() (*gopacket.PacketSource, error)
+
+	// Output replaces the ICMP socket outbound messages are written to when
+	// Source is set, and is ignored otherwise, it is shared by all
+	// connections and left open. Neither works with Unprivileged.
+	Output net.PacketConn
+}
+
+// CaptureOptions tunes the pcap capture of inbound packets, the defaults
+// deliver every packet as soon as it arrives to keep KCP's latency low.
+type CaptureOptions struct {
+	NoImmediate bool          // let the kernel batch packets until the buffer fills or the timeout expires
+	BufferSize  int           // capture buffer size in bytes, 0 for the libpcap default
+	Timeout     time.Duration // read timeout, 0 for 100ms
+}
+
+// echoID returns the echo identifier for a new ICMPConn, and whether the
+// peer knows it in advance so it can be used to filter inbound packets
+func (t *ICMPTransport) echoID() (id int, shared bool) {
+	switch t.EchoIDMode {
+	case EchoIDFixed:
+		return int(t.EchoID), true
+	case EchoIDKeyed:
+		sum := sha256.Sum256(append([]byte("kcp-go echo id"), t.EchoIDKey...))
+		return int(binary.BigEndian.Uint16(sum[:])), true
+	}
+	var random uint16
+	binary.Read(rand.Reader, binary.LittleEndian, &random)
+	return int(random), false
+}
+
+// tags returns the direction tags prefixing the payloads of echo requests and
+// echo replies. Hosts answering pings echo the request payload back, so its tag
+// tells such replies apart from the ones sent by the server; with EchoIDKey
+// set, the tags are derived from it to keep other tunnels' packets out too.
+func (t *ICMPTransport) tags() (request, reply []byte) {
+	tag := func(direction string) []byte {
+		sum := sha256.Sum256(append([]byte("kcp-go "+direction), t.EchoIDKey...))
+		return sum[:icmpTagSize]
+	}
+	return tag("request"), tag("reply")
+}
+
+// devices returns the interfaces set to capture on, nil to pick them
+func (t *ICMPTransport) devices() []string {
+	if len(t.Devs) > 0 {
+		return t.Devs
+	}
+	if t.Dev != "" {
+		return []string{t.Dev}
+	}
+	return nil
+}
+
+// ICMPAddr is the address of an ICMP tunnel peer, its IP address along with
+// the echo identifier of the tunnel
+type ICMPAddr struct {
+	IP   net.IP
+	Zone string // IPv6 scoped addressing zone
+	ID   int    // echo identifier
+
+	// the local address and interface the peer's packets arrived on,
+	// messages to the peer are sent from there when set
+	local   net.IP
+	ifindex int
+}
+
+// Network returns the address's network name, "icmp"
+func (a *ICMPAddr) Network() string { return "icmp" }
+
+// String returns the address in the form "ip#id"
+func (a *ICMPAddr) String() string {
+	return (&net.IPAddr{IP: a.IP, Zone: a.Zone}).String() + "#" + strconv.Itoa(a.ID)
+}
+
+// Dial opens an ICMPConn sending echo requests to raddr
+func (t *ICMPTransport) Dial(raddr string) (net.PacketConn, net.Addr, error) {
+	ipaddr, err := net.ResolveIPAddr("ip", raddr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "net.ResolveIPAddr")
+	}
+
+	id, _ := t.echoID()
+	addr := &ICMPAddr{IP: ipaddr.IP, Zone: ipaddr.Zone, ID: id}
+	conn, err := dialICMPConn(t, icmpFamilyOf(addr.IP), "", addr, id, false)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "dialICMPConn")
+	}
+	return conn, addr, nil
+}
+
+// Listen opens an ICMPConn answering echo requests addressed to laddr, an
+// empty laddr listens for ICMP on all IPv4 addresses
+func (t *ICMPTransport) Listen(laddr string) (net.PacketConn, error) {
+	family := icmpv4
+	if laddr != "" {
+		addr, err := net.ResolveIPAddr("ip", laddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.ResolveIPAddr")
+		}
+		family = icmpFamilyOf(addr.IP)
+	}
+
+	// listeners answer with the identifier each client chose,
+	// and filter on it only if it's agreed in advance
+	id, shared := t.echoID()
+	if !shared {
+		id = anyEchoID
+	}
+
+	conn, err := dialICMPConn(t, family, laddr, nil, id, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialICMPConn")
+	}
+	return conn, nil
+}
+
+// Overhead returns the IP and ICMP header size of the carrier, plus the
+// direction tag. With Shape set, every echo message carries its own headers
+// for a small chunk of the packet, the overhead sizes packets so their
+// messages together take no more than the default MTU on the wire, keeping
+// both the overhead and the messages a lost one takes down with it bounded.
+func (t *ICMPTransport) Overhead(addr net.Addr) int {
+	header := icmpHeaderSize - icmpTypeCodeSize
+	if carrier, err := icmpFamilyOf(addrIP(addr)).carrier(t.Carrier); err == nil {
+		header = carrier.header
+	}
+	if t.Shape {
+		message := ipHeaderSize(addr) + icmpTypeCodeSize + header + shapePayloadSize
+		return IKCP_MTU_DEF - IKCP_MTU_DEF/message*shapeChunkSize
+	}
+	return ipHeaderSize(addr) + icmpTypeCodeSize + header + icmpTagSize
+}
+
+// anyEchoID makes an ICMPConn accept packets with any echo identifier
+const anyEchoID = -1
+
+// icmpFilter selects the inbound ICMP messages of an ICMPConn
+type icmpFilter struct {
+	src      net.IP // peer address, nil to accept any
+	typ      int    // message type
+	id       int    // identifier, or anyEchoID
+	idOffset uint32 // offset of the identifier in the message
+}
+
+// pcapFilter returns the pcap filter expression capturing the messages
+// selected by filter
+func (f *icmpFamily) pcapFilter(filter icmpFilter) string {
+	// ICMPv6 has no field accessor, the offsets assume no extension
+	// headers, as ICMPv6 packets rarely have any
+	field := func(off uint32, size int) string {
+		if f == icmpv6 {
+			return fmt.Sprintf("ip6[%d:%d]", ipv6.HeaderLen+off, size)
+		}
+		return fmt.Sprintf("icmp[%d:%d]", off, size)
+	}
+
+	expr := f.filter
+	if filter.src != nil {
+		expr += " and src host " + filter.src.String()
+	}
+	checks := fmt.Sprintf("%s == %d", field(0, 1), filter.typ)
+	if filter.id != anyEchoID {
+		checks += fmt.Sprintf(" and %s == %d", field(filter.idOffset, 2), filter.id)
+	}
+
+	// the ICMP header is only in the first fragment of a datagram, let the
+	// others through for reassembly
+	if f == icmpv4 {
+		return expr + " and (ip[6:2] & 0x1fff != 0 or (" + checks + "))"
+	}
+	return expr + " and " + checks
+}
+
+// icmpPath is how an inbound ICMP message reached the host
+type icmpPath struct {
+	src     net.IP // the sender
+	dst     net.IP // the local address it was sent to, nil if unknown
+	ifindex int    // the interface it arrived on, 0 if unknown
+}
+
+// addr returns the address of the sender with the echo identifier id, sending
+// to it goes out of the interface and from the local address the message
+// arrived on, unless it was sent to a group address this host can't send from
+func (p icmpPath) addr(id int) *ICMPAddr {
+	addr := &ICMPAddr{IP: p.src, ID: id, local: p.dst, ifindex: p.ifindex}
+	if p.dst != nil && (p.dst.IsMulticast() || p.dst.Equal(net.IPv4bcast)) {
+		addr.local = nil
+	}
+	return addr
+}
+
+// icmpReader reads the inbound ICMP messages of an ICMPConn, the raw socket
+// reader is always available, while the pcap reader needs cgo and libpcap.
+type icmpReader interface {
+	// ReadICMP reads the next ICMP message, without the IP header, into b
+	ReadICMP(b []byte) (n int, path icmpPath, err error)
+
+	// SetReadDeadline sets the deadline for ReadICMP, which fails with a
+	// net.Error timeout once it passes
+	SetReadDeadline(t time.Time) error
+
+	// Close releases the resources of the reader and unblocks ReadICMP, the
+	// ICMP socket is left open
+	Close() error
+}
+
+// ICMPConn is a net.PacketConn exchanging packets in ICMP echo messages
+type ICMPConn struct {
+	conn        net.PacketConn // the ICMP socket, or ICMPTransport.Output
+	ownConn     bool           // close conn along with the connection
+	ping        bool           // conn is an unprivileged ping socket, addressed by UDP addresses
+	family      *icmpFamily
+	carrier     *icmpCarrier
+	devices     []string // interfaces inbound packets are captured on
+	local       net.IP   // the local address messages are sent from, if the peer's packets don't tell
+	remote      *ICMPAddr
+	id          int // echo identifier to accept, and to send to addresses without one
+	sendReplies bool
+	seq         uint16
+	inTag       []byte // direction tag of inbound payloads
+	outTag      []byte // direction tag of outbound payloads
+
+	// ping responder
+	pingReplies   bool      // answer echo requests not belonging to the tunnel
+	pingRateLimit int       // maximum ping replies per second, 0 for no limit
+	pingWindow    time.Time // start of the current rate limit window
+	pingCount     int       // ping replies sent in the current window
+
+	// ping lookalike shaping
+	shape         bool
+	shapeInterval time.Duration      // minimum time between echo messages
+	shapeID       uint16             // id of the next packet split into fragments
+	reassembler   *shapeReassembler  // inbound fragments, protected by rmu
+	chShaped      chan shapedMessage // messages waiting to be paced, nil without ShapeInterval
+
+	reader icmpReader // inbound ICMP messages
+	rbuf   []byte     // buffer for the message being read
+	rmu    sync.Mutex // serializes readers on rbuf
+
+	wd atomic.Value // write deadline, applied by WriteTo rather than to a shared output
+
+	// request/reply budget mode
+	budget  int                  // outstanding echo requests, 0 if disabled
+	pending map[uint16]time.Time // client: outstanding requests by seq
+	peers   map[string]*echoPeer // server: requests and queued replies by client
+	sweep   time.Time            // server: last time idle peers were removed
+	chPoll  chan struct{}        // client: notify the poller a request was answered
+
+	die     chan struct{} // notify the connection has closed
+	dieOnce sync.Once
+	mu      sync.Mutex // protects seq and the budget mode states
+}
+
+func dialICMPConn(t *ICMPTransport, family *icmpFamily, laddr string, remote *ICMPAddr, id int, sendReplies bool) (*ICMPConn, error) {
+	carrier, err := family.carrier(t.Carrier)
+	if err != nil {
+		return nil, err
+	}
+
+	// ping sockets only send echo requests, with the identifier of the socket
+	unprivileged := t.Unprivileged
+	if unprivileged {
+		switch {
+		case t.Source != nil || t.Output != nil:
+			return nil, errors.New("kcp: unprivileged ping sockets can't be replaced by Source or Output")
+		case sendReplies:
+			return nil, errors.New("kcp: unprivileged ping sockets can't answer echo requests")
+		case t.Carrier != CarrierEcho:
+			return nil, errors.New("kcp: unprivileged ping sockets only carry echo messages")
+		case t.EchoIDMode != EchoIDRandom:
+			return nil, errors.New("kcp: unprivileged ping sockets pick their own echo identifier")
+		}
+	}
+
+	if laddr == "" {
+		laddr = family.wildcard
+	}
+
+	// servers read requests, clients read replies
+	typ := carrier.reply
+	requestTag, replyTag := t.tags()
+	inTag, outTag := replyTag, requestTag
+	if sendReplies {
+		typ = carrier.request
+		inTag, outTag = requestTag, replyTag
+	}
+
+	// the ping responder needs to see every echo request
+	pingReplies := sendReplies && t.PingReplies && t.Carrier == CarrierEcho
+	filter := icmpFilter{nil, family.typeNumber(typ), id, carrier.idOffset}
+	if remote != nil {
+		filter.src = remote.IP
+	}
+	if pingReplies {
+		filter.id = anyEchoID
+	}
+
+	// an injected source replaces the capture, and an injected output the
+	// ICMP socket, which is only opened, and closed along with the
+	// connection, if either needs it
+	var conn net.PacketConn
+	var reader icmpReader
+	ownConn := false
+	if t.Source != nil {
+		source, err := t.Source()
+		if err != nil {
+			return nil, err
+		}
+		reader = newPacketReader(family, source.Packets(), nil, false)
+		conn = t.Output
+	}
+	if unprivileged {
+		icmpConn, err := icmp.ListenPacket(family.ping, laddr)
+		if err != nil {
+			return nil, err
+		}
+		// Linux replaces the echo identifier with the socket's port
+		if addr, ok := icmpConn.LocalAddr().(*net.UDPAddr); ok && addr.Port != 0 {
+			id = addr.Port
+			remote.ID = id
+		}
+		conn, reader, ownConn = icmpConn, newPingReader(icmpConn), true
+	}
+
+	// capture on the interface of the route to the peer unless told
+	// otherwise, the raw socket read without pcap receives on all of them
+	var devices []string
+	if t.Source == nil && !unprivileged && pcapCapture {
+		if devices, err = captureDevices(family, t.devices(), laddr, remote); err != nil {
+			return nil, err
+		}
+	}
+
+	if conn == nil {
+		icmpConn, err := listenRawSocket(family, laddr)
+		if err != nil {
+			return nil, err
+		}
+		conn, ownConn = icmpConn, true
+		if reader == nil {
+			if reader, err = openICMPReader(family, icmpConn, devices, t.Capture, filter); err != nil {
+				icmpConn.Close()
+				return nil, err
+			}
+		}
+	}
+
+	// the unreachable carrier quotes the local address
+	var local net.IP
+	if ip := net.ParseIP(laddr); ip != nil && !ip.IsUnspecified() {
+		local = ip
+	} else if remote != nil && t.Carrier == CarrierUnreachable {
+		local, _ = sourceAddr(remote.IP)
+	}
+
+	c := &ICMPConn{
+		conn:          conn,
+		local:         local,
+		ownConn:       ownConn,
+		ping:          unprivileged,
+		family:        family,
+		carrier:       carrier,
+		devices:       devices,
+		remote:        remote,
+		id:            id,
+		sendReplies:   sendReplies,
+		seq:           0,
+		inTag:         inTag,
+		outTag:        outTag,
+		pingReplies:   pingReplies,
+		pingRateLimit: t.PingRateLimit,
+		shape:         t.Shape,
+		shapeInterval: t.ShapeInterval,
+		reader:        reader,
+		rbuf:          make([]byte, icmpReadBufferSize),
+		budget:        t.Budget,
+		die:           make(chan struct{}),
+	}
+
+	if c.shape {
+		c.reassembler = newShapeReassembler()
+	}
+	if c.shapeInterval > 0 {
+		c.chShaped = make(chan shapedMessage, shapeMaxQueue)
+		go c.shaper()
+	}
+
+	if c.budget > 0 {
+		if sendReplies {
+			c.peers = make(map[string]*echoPeer)
+		} else {
+			c.pending = make(map[uint16]time.Time)
+			c.chPoll = make(chan struct{}, 1)
+			go c.poller()
+		}
+	}
+	return c, nil
+}
+
+func (c *ICMPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		n, path, err := c.reader.ReadICMP(c.rbuf)
+		if err != nil {
+			select {
+			case <-c.die:
+				return 0, nil, errors.New(errBrokenPipe)
+			default:
+				return 0, nil, err
+			}
+		}
+
+		src := path.src
+		if c.remote != nil && !c.remote.IP.Equal(src) {
+			continue
+		}
+
+		msg := c.rbuf[:n]
+		if len(msg) < icmpTypeCodeSize {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			continue
+		}
+
+		// servers should have received requests, clients replies
+		typ := c.carrier.reply
+		if c.sendReplies {
+			typ = c.carrier.request
+		}
+		if int(msg[0]) != c.family.typeNumber(typ) {
+			continue
+		}
+
+		// malformed messages are dropped, an error would stop the receivers
+		if int(msg[1]) != c.carrier.code {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			continue
+		}
+
+		id, seq, payload, ok := c.carrier.parse(msg[icmpTypeCodeSize:])
+		if !ok {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			continue
+		}
+
+		tag, data := c.untag(payload)
+		if (c.id != anyEchoID && id != c.id) || !bytes.Equal(tag, c.inTag) {
+			// drop our own payloads echoed back by the peer's host, and answer
+			// pings from anyone else
+			if tag != nil && bytes.Equal(tag, c.outTag) {
+				atomic.AddUint64(&DefaultSnmp.ICMPReflected, 1)
+			} else if c.pingReplies {
+				c.answerPing(path, &icmp.Echo{ID: id, Seq: seq, Data: payload})
+			}
+			continue
+		}
+
+		from := path.addr(id)
+		if c.budget > 0 {
+			if c.sendReplies {
+				c.requestReceived(from, uint16(seq))
+			} else {
+				c.replyReceived(uint16(seq))
+			}
+		}
+
+		if c.shape {
+			packet, ok := c.reassembler.add(from.String(), data, time.Now())
+			if !ok {
+				continue
+			}
+			data = packet
+		}
+
+		// empty requests only poll for replies
+		if c.budget > 0 && len(data) == 0 {
+			continue
+		}
+
+		return copy(p, data), from, nil
+	}
+}
+
+func (c *ICMPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if deadline, ok := c.wd.Load().(time.Time); ok && !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, errTimeout{}
+	}
+
+	// reply with the identifier the peer chose
+	var dst *ICMPAddr
+	switch a := addr.(type) {
+	case *ICMPAddr:
+		dst = a
+	case *net.IPAddr:
+		// listeners have no identifier of their own, only the peer's tells
+		if c.id == anyEchoID {
+			return 0, errors.New("kcp: ICMP listeners need an *ICMPAddr naming the peer's echo identifier")
+		}
+		dst = &ICMPAddr{IP: a.IP, Zone: a.Zone, ID: c.id}
+	default:
+		return 0, errors.New(errInvalidOperation)
+	}
+
+	msgs, err := c.messages(b)
+	if err != nil {
+		return 0, err
+	}
+	// paced packets are dropped whole when their messages don't fit in the queue
+	if c.chShaped != nil && len(c.chShaped)+len(msgs) > cap(c.chShaped) {
+		return len(b), nil
+	}
+
+	for _, msg := range msgs {
+		if c.budget > 0 && c.sendReplies {
+			if _, err := c.queueReply(msg, dst); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		seq := c.seq
+		c.seq++
+		if c.budget > 0 {
+			c.pending[seq] = time.Now()
+		}
+		c.mu.Unlock()
+
+		if err := c.writeEcho(dst, seq, msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// messages returns the tunnel messages carrying packet b, which are its
+// fragments when shaping
+func (c *ICMPConn) messages(b []byte) ([][]byte, error) {
+	if !c.shape {
+		return [][]byte{b}, nil
+	}
+
+	c.mu.Lock()
+	id := c.shapeID
+	c.shapeID++
+	c.mu.Unlock()
+	return shapeFragments(id, b)
+}
+
+// untag splits an echo payload into its direction tag and the tunnel message,
+// the tag is nil if the payload is too short to carry one
+func (c *ICMPConn) untag(data []byte) (tag, msg []byte) {
+	offset := 0
+	if c.shape {
+		offset = shapeTimestampSize
+	}
+	if len(data) < offset+icmpTagSize {
+		return nil, nil
+	}
+	return data[offset : offset+icmpTagSize], data[offset+icmpTagSize:]
+}
+
+// writeEcho sends the tunnel message b to dst in a carrier message with
+// sequence number seq, or queues it for the shaper when pacing
+func (c *ICMPConn) writeEcho(dst *ICMPAddr, seq uint16, b []byte) error {
+	if c.chShaped != nil {
+		select {
+		case c.chShaped <- shapedMessage{dst, seq, append([]byte(nil), b...)}:
+		default:
+		}
+		return nil
+	}
+	return c.sendEcho(dst, seq, b)
+}
+
+// sendEcho sends the tunnel message b to dst in a carrier message with sequence number seq
+func (c *ICMPConn) sendEcho(dst *ICMPAddr, seq uint16, b []byte) error {
+	typ := c.carrier.request
+	if c.sendReplies {
+		typ = c.carrier.reply
+	}
+
+	now := time.Now()
+	var data []byte
+	if c.shape {
+		data = shapePayload(c.outTag, b, now)
+	} else {
+		data = make([]byte, icmpTagSize+len(b))
+		copy(data, c.outTag)
+		copy(data[icmpTagSize:], b)
+	}
+	local := dst.local
+	if local == nil {
+		local = c.local
+	}
+	body := &icmp.RawBody{Data: c.carrier.marshal(dst.ID, int(seq), data, now, local, dst.IP)}
+	return c.writeMessage(dst, typ, c.carrier.code, body)
+}
+
+// writeMessage sends an ICMP message to dst, out of the interface and from
+// the local address dst's packets arrived on if they're known
+func (c *ICMPConn) writeMessage(dst *ICMPAddr, typ icmp.Type, code int, body icmp.MessageBody) error {
+	payload, err := (&icmp.Message{Type: typ, Code: code, Body: body}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	var to net.Addr = &net.IPAddr{IP: dst.IP, Zone: dst.Zone}
+	if c.ping {
+		to = &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+	}
+	if conn, ok := c.conn.(icmpSocket); ok && (dst.local != nil || dst.ifindex != 0) {
+		cm4, cm6 := dst.controlMessages()
+		if p := conn.IPv4PacketConn(); p != nil {
+			_, err = p.WriteTo(payload, cm4, to)
+			return err
+		}
+		if p := conn.IPv6PacketConn(); p != nil {
+			_, err = p.WriteTo(payload, cm6, to)
+			return err
+		}
+	}
+	_, err = c.conn.WriteTo(payload, to)
+	return err
+}
+
+// controlMessages returns the control messages sending packets to a out of
+// the interface and from the local address a's packets arrived on
+func (a *ICMPAddr) controlMessages() (*ipv4.ControlMessage, *ipv6.ControlMessage) {
+	return &ipv4.ControlMessage{Src: a.local, IfIndex: a.ifindex}, &ipv6.ControlMessage{Src: a.local, IfIndex: a.ifindex}
+}
+
+// answerPing replies to an echo request not belonging to the tunnel the way
+// the kernel would, unless the rate limit is reached
+func (c *ICMPConn) answerPing(path icmpPath, req *icmp.Echo) {
+	if c.pingAllowed(time.Now()) {
+		c.writeMessage(path.addr(0), c.family.echoReply, 0, req)
+	}
+}
+
+// pingAllowed checks and updates the rate limit of ping replies
+func (c *ICMPConn) pingAllowed(now time.Time) bool {
+	if c.pingRateLimit <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.pingWindow) >= time.Second {
+		c.pingWindow = now
+		c.pingCount = 0
+	}
+	if c.pingCount >= c.pingRateLimit {
+		return false
+	}
+	c.pingCount++
+	return true
+}
+
+// Close closes the connection, blocked ReadFrom calls return an error
+func (c *ICMPConn) Close() error {
+	err := errors.New(errBrokenPipe)
+	c.dieOnce.Do(func() {
+		close(c.die)
+		c.reader.Close()
+		err = nil
+		if c.ownConn {
+			err = c.conn.Close()
+		}
+	})
+	return err
+}
+
+// Devices returns the interfaces inbound packets are captured on, picked from
+// the routing table unless ICMPTransport.Dev or Devs is set. It's empty in
+// builds without pcap, which read every interface from the raw ICMP socket.
+func (c *ICMPConn) Devices() []string { return c.devices }
+
+func (c *ICMPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *ICMPConn) SetDeadline(t time.Time) error {
+	if err := c.reader.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of ReadFrom, the inbound messages may not
+// come from the ICMP socket, so the deadline is applied by the reader
+func (c *ICMPConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of WriteTo, it's applied to the ICMP
+// socket too unless it's an injected output, which other connections may share
+func (c *ICMPConn) SetWriteDeadline(t time.Time) error {
+	c.wd.Store(t)
+	if c.ownConn {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// SetDontFragment sets DF on the messages sent, so the ones larger than the
+// path MTU are dropped instead of fragmented, which path MTU discovery
+// relies on. It's only supported by the privileged ICMP socket on Linux, and
+// applies to every ICMPConn sharing an injected output.
+func (c *ICMPConn) SetDontFragment(enable bool) error {
+	return dontFragment(c.conn, enable)
+}
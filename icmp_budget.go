@@ -0,0 +1,172 @@
+package kcp
+
+import (
+	"time"
+)
+
+const (
+	// echo requests unanswered for this long are considered lost by clients,
+	// and too old to be answered by servers
+	echoRequestTimeout = 5 * time.Second
+
+	// clients check for lost echo requests at this interval
+	echoPollInterval = 100 * time.Millisecond
+
+	// servers forget clients sending no requests for this long
+	echoPeerTimeout = time.Minute
+
+	// maximum outstanding requests a server keeps for a client
+	echoMaxRequests = 1024
+
+	// maximum outbound packets a server queues for a client out of requests
+	echoMaxQueue = qlen
+)
+
+type (
+	// echoPeer is a client of a server in request/reply budget mode
+	echoPeer struct {
+		requests []echoRequest // outstanding requests, oldest first
+		queue    [][]byte      // packets waiting for a request to reply to
+		lastSeen time.Time     // the last time a request arrived
+	}
+
+	// echoRequest is an echo request waiting for its reply
+	echoRequest struct {
+		seq uint16
+		ts  time.Time
+	}
+)
+
+// takeRequest removes the oldest request still worth answering
+func (p *echoPeer) takeRequest(now time.Time) (seq uint16, ok bool) {
+	for len(p.requests) > 0 {
+		req := p.requests[0]
+		p.requests = p.requests[1:]
+		if now.Sub(req.ts) < echoRequestTimeout {
+			return req.seq, true
+		}
+	}
+	return 0, false
+}
+
+// poller keeps the client's budget of echo requests outstanding, topping it up
+// with empty requests whenever some are answered or lost
+func (c *ICMPConn) poller() {
+	ticker := time.NewTicker(echoPollInterval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		for seq, ts := range c.pending {
+			if now.Sub(ts) >= echoRequestTimeout {
+				delete(c.pending, seq)
+			}
+		}
+
+		var polls []uint16
+		for len(c.pending) < c.budget {
+			polls = append(polls, c.seq)
+			c.pending[c.seq] = now
+			c.seq++
+		}
+		c.mu.Unlock()
+
+		for _, seq := range polls {
+			if msgs, err := c.messages(nil); err == nil {
+				c.writeEcho(c.remote, seq, msgs[0])
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.chPoll:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// replyReceived marks the client's request seq as answered
+func (c *ICMPConn) replyReceived(seq uint16) {
+	c.mu.Lock()
+	delete(c.pending, seq)
+	c.mu.Unlock()
+
+	select {
+	case c.chPoll <- struct{}{}:
+	default:
+	}
+}
+
+// requestReceived records an echo request from a client of the server, and
+// answers it right away if packets are queued for the client
+func (c *ICMPConn) requestReceived(from *ICMPAddr, seq uint16) {
+	now := time.Now()
+	key := from.String()
+
+	c.mu.Lock()
+	if now.Sub(c.sweep) >= echoPeerTimeout {
+		for k, p := range c.peers {
+			if now.Sub(p.lastSeen) >= echoPeerTimeout {
+				delete(c.peers, k)
+			}
+		}
+		c.sweep = now
+	}
+
+	peer, ok := c.peers[key]
+	if !ok {
+		peer = new(echoPeer)
+		c.peers[key] = peer
+	}
+	peer.lastSeen = now
+	peer.requests = append(peer.requests, echoRequest{seq, now})
+	if len(peer.requests) > echoMaxRequests {
+		peer.requests = peer.requests[len(peer.requests)-echoMaxRequests:]
+	}
+
+	var data []byte
+	if len(peer.queue) > 0 {
+		seq, _ = peer.takeRequest(now)
+		data = peer.queue[0]
+		peer.queue[0] = nil
+		peer.queue = peer.queue[1:]
+	}
+	c.mu.Unlock()
+
+	if data != nil {
+		c.writeEcho(from, seq, data)
+	}
+}
+
+// queueReply sends b to a client as the reply to its oldest outstanding
+// request, or queues it until the client sends one
+func (c *ICMPConn) queueReply(b []byte, dst *ICMPAddr) (int, error) {
+	now := time.Now()
+	key := dst.String()
+
+	c.mu.Lock()
+	peer, ok := c.peers[key]
+	if !ok {
+		peer = &echoPeer{lastSeen: now}
+		c.peers[key] = peer
+	}
+
+	if seq, ok := peer.takeRequest(now); ok {
+		c.mu.Unlock()
+		if err := c.writeEcho(dst, seq, b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	// out of requests, the packet waits for the next one and is dropped if
+	// the queue is full, KCP retransmits it just like a lost packet
+	if len(peer.queue) < echoMaxQueue {
+		data := make([]byte, len(b))
+		copy(data, b)
+		peer.queue = append(peer.queue, data)
+	}
+	c.mu.Unlock()
+	return len(b), nil
+}
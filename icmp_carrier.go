@@ -0,0 +1,187 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Carrier selects the ICMP messages tunnel packets travel in
+type Carrier int
+
+const (
+	// CarrierEcho sends echo requests and echo replies
+	CarrierEcho Carrier = iota
+	// CarrierTimestamp sends timestamp requests and timestamp replies, IPv4 only
+	CarrierTimestamp
+	// CarrierUnreachable sends port unreachable messages in both directions,
+	// quoting a made up UDP datagram carrying the packet, from the peer's
+	// address and the echo identifier as port to the local address and port
+	// unreachablePort
+	CarrierUnreachable
+)
+
+const (
+	// size of the ICMP type, code and checksum fields
+	icmpTypeCodeSize = 4
+
+	// size of the timestamp message fields following the identifier and
+	// sequence number
+	icmpTimestampsSize = 12
+
+	// code of port unreachable messages
+	icmpv4CodePortUnreachable = 3
+	icmpv6CodePortUnreachable = 4
+
+	// IANA protocol number of UDP
+	protocolUDP = 17
+
+	// destination port of the UDP datagrams quoted by port unreachable
+	// messages, the same for every message so the quoted flow stays put
+	unreachablePort = 53
+)
+
+// icmpCarrier holds the message types and body layout of a Carrier
+type icmpCarrier struct {
+	request  icmp.Type // message type sent by clients
+	reply    icmp.Type // message type sent by servers
+	code     int
+	idOffset uint32 // offset of the identifier in the ICMP message
+	header   int    // size of the message body preceding the data
+
+	// marshal builds the body of a message sent from local to peer, parse
+	// takes it apart, both without the type, code and checksum fields
+	marshal func(id, seq int, data []byte, now time.Time, local, peer net.IP) []byte
+	parse   func(body []byte) (id, seq int, data []byte, ok bool)
+}
+
+// carrier returns the icmpCarrier of c in the family
+func (f *icmpFamily) carrier(c Carrier) (*icmpCarrier, error) {
+	switch c {
+	case CarrierEcho:
+		return &icmpCarrier{
+			request: f.echoRequest, reply: f.echoReply,
+			idOffset: icmpTypeCodeSize,
+			header:   icmpHeaderSize - icmpTypeCodeSize,
+			marshal:  marshalIDSeq(0),
+			parse:    parseIDSeq(0),
+		}, nil
+	case CarrierTimestamp:
+		if f != icmpv4 {
+			return nil, errors.New("kcp: timestamp carrier needs IPv4")
+		}
+		return &icmpCarrier{
+			request: ipv4.ICMPTypeTimestamp, reply: ipv4.ICMPTypeTimestampReply,
+			idOffset: icmpTypeCodeSize,
+			header:   icmpHeaderSize - icmpTypeCodeSize + icmpTimestampsSize,
+			marshal:  marshalIDSeq(icmpTimestampsSize),
+			parse:    parseIDSeq(icmpTimestampsSize),
+		}, nil
+	case CarrierUnreachable:
+		typ, code, quoted := icmp.Type(ipv4.ICMPTypeDestinationUnreachable), icmpv4CodePortUnreachable, ipv4.HeaderLen
+		if f == icmpv6 {
+			typ, code, quoted = ipv6.ICMPTypeDestinationUnreachable, icmpv6CodePortUnreachable, ipv6.HeaderLen
+		}
+		// the unused field, the quoted IP header, the UDP header holding
+		// the identifier as the source port, then the sequence number
+		header := 4 + quoted + udpHeaderSize + 2
+		return &icmpCarrier{
+			request: typ, reply: typ, code: code,
+			idOffset: uint32(icmpTypeCodeSize + 4 + quoted),
+			header:   header,
+			marshal:  f.marshalUnreachable(header),
+			parse:    parseUnreachable(header),
+		}, nil
+	}
+	return nil, errors.Errorf("kcp: unknown ICMP carrier %d", c)
+}
+
+// marshalIDSeq lays out echo and timestamp message bodies, the identifier and
+// sequence number followed by extra bytes of fields, then the data. The
+// timestamps are milliseconds since midnight UTC.
+func marshalIDSeq(extra int) func(id, seq int, data []byte, now time.Time, local, peer net.IP) []byte {
+	return func(id, seq int, data []byte, now time.Time, local, peer net.IP) []byte {
+		b := make([]byte, 4+extra+len(data))
+		binary.BigEndian.PutUint16(b, uint16(id))
+		binary.BigEndian.PutUint16(b[2:], uint16(seq))
+		if extra > 0 {
+			ms := uint32(now.UTC().Sub(now.UTC().Truncate(24*time.Hour)) / time.Millisecond)
+			for off := 4; off+4 <= 4+extra; off += 4 {
+				binary.BigEndian.PutUint32(b[off:], ms)
+			}
+		}
+		copy(b[4+extra:], data)
+		return b
+	}
+}
+
+func parseIDSeq(extra int) func(body []byte) (id, seq int, data []byte, ok bool) {
+	return func(body []byte) (id, seq int, data []byte, ok bool) {
+		if len(body) < 4+extra {
+			return 0, 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(body)), int(binary.BigEndian.Uint16(body[2:])), body[4+extra:], true
+	}
+}
+
+// marshalUnreachable lays out port unreachable message bodies, quoting the
+// headers of a UDP datagram the peer would have sent to the local address,
+// from the identifier to unreachablePort, the sequence number leads its
+// payload
+func (f *icmpFamily) marshalUnreachable(header int) func(id, seq int, data []byte, now time.Time, local, peer net.IP) []byte {
+	return func(id, seq int, data []byte, now time.Time, local, peer net.IP) []byte {
+		b := make([]byte, header+len(data))
+		udp := b[header-udpHeaderSize-2 : header]
+		ip := b[4 : header-len(udp)]
+		if f == icmpv4 {
+			ip[0] = 4<<4 | ipv4.HeaderLen>>2
+			binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(udp)+len(data)))
+			ip[8] = 64 // TTL
+			ip[9] = protocolUDP
+			copy(ip[12:16], peer.To4())
+			copy(ip[16:20], local.To4())
+			binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip))
+		} else {
+			ip[0] = 6 << 4
+			binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)+len(data)))
+			ip[6] = protocolUDP
+			ip[7] = 64 // hop limit
+			copy(ip[8:24], peer.To16())
+			copy(ip[24:40], local.To16())
+		}
+		binary.BigEndian.PutUint16(udp, uint16(id))
+		binary.BigEndian.PutUint16(udp[2:], unreachablePort)
+		binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)+len(data)))
+		binary.BigEndian.PutUint16(udp[udpHeaderSize:], uint16(seq))
+		copy(b[header:], data)
+		return b
+	}
+}
+
+func parseUnreachable(header int) func(body []byte) (id, seq int, data []byte, ok bool) {
+	return func(body []byte) (id, seq int, data []byte, ok bool) {
+		if len(body) < header {
+			return 0, 0, nil, false
+		}
+		udp := body[header-udpHeaderSize-2:]
+		return int(binary.BigEndian.Uint16(udp)), int(binary.BigEndian.Uint16(udp[udpHeaderSize:])), body[header:], true
+	}
+}
+
+// ipv4Checksum returns the checksum of an IPv4 header whose checksum field is zero
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for k := 0; k+1 < len(header); k += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[k:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
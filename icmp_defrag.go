@@ -0,0 +1,184 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// how long the fragments of a datagram may take to arrive, as Linux waits
+	defragTimeout = 30 * time.Second
+
+	// bytes of fragments held at once, and fragments per datagram
+	defragMaxBytes     = 4 << 20
+	defragMaxFragments = 64
+
+	// maximum size of a reassembled IPv4 payload
+	defragMaxSize = 65535 - ipv4.HeaderLen
+)
+
+type (
+	// ipv4Reassembler puts IPv4 datagrams back together from the fragments
+	// captured by pcap, the kernel does it for the raw socket. Overlapping
+	// fragments drop the whole datagram rather than guessing which is right.
+	ipv4Reassembler struct {
+		packets map[ipv4FragKey]*ipv4FragPacket
+		size    int       // bytes held by all the datagrams
+		sweep   time.Time // last time timed out datagrams were removed
+	}
+
+	// ipv4FragKey identifies a datagram being reassembled
+	ipv4FragKey struct {
+		src, dst [4]byte
+		id       uint16
+		protocol layers.IPProtocol
+	}
+
+	// ipv4FragPacket is a datagram being reassembled
+	ipv4FragPacket struct {
+		frags []ipv4Frag
+		size  int       // bytes of the fragments received
+		total int       // payload size, -1 until the last fragment arrives
+		ts    time.Time // arrival of the first fragment
+	}
+
+	// ipv4Frag is a received fragment of a datagram
+	ipv4Frag struct {
+		offset int
+		data   []byte
+	}
+)
+
+func newIPv4Reassembler() *ipv4Reassembler {
+	r := new(ipv4Reassembler)
+	r.packets = make(map[ipv4FragKey]*ipv4FragPacket)
+	return r
+}
+
+// isFragment reports whether ip is a fragment of a larger datagram
+func isFragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// add records the fragment ip, and returns the payload of its datagram once
+// all of the fragments arrived, malformed fragments are ignored
+func (r *ipv4Reassembler) add(ip *layers.IPv4, now time.Time) (payload []byte, ok bool) {
+	if now.Sub(r.sweep) >= time.Second {
+		r.expire(now)
+		r.sweep = now
+	}
+
+	more := ip.Flags&layers.IPv4MoreFragments != 0
+	offset := int(ip.FragOffset) * 8
+	end := offset + len(ip.Payload)
+	if (more && len(ip.Payload)%8 != 0) || end > defragMaxSize {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		return nil, false
+	}
+
+	key := ipv4FragKey{id: ip.Id, protocol: ip.Protocol}
+	copy(key.src[:], ip.SrcIP.To4())
+	copy(key.dst[:], ip.DstIP.To4())
+	p, exists := r.packets[key]
+	if exists && now.Sub(p.ts) >= defragTimeout {
+		r.drop(key)
+		exists = false
+	}
+	if !exists {
+		p = &ipv4FragPacket{total: -1, ts: now}
+	}
+
+	// the datagram's size is fixed by its last fragment, and no fragment
+	// may overlap another, though retransmitted duplicates are harmless
+	if (!more && p.total >= 0 && end != p.total) || (p.total >= 0 && end > p.total) {
+		r.drop(key)
+		return nil, false
+	}
+	for _, f := range p.frags {
+		if offset < f.offset+len(f.data) && f.offset < end {
+			if f.offset == offset && len(f.data) == len(ip.Payload) {
+				return nil, false
+			}
+			r.drop(key)
+			return nil, false
+		}
+		if !more && f.offset+len(f.data) > end {
+			r.drop(key)
+			return nil, false
+		}
+	}
+	if len(p.frags) >= defragMaxFragments {
+		r.drop(key)
+		return nil, false
+	}
+
+	// make room by dropping the oldest datagrams
+	for r.size+len(ip.Payload) > defragMaxBytes {
+		if !r.dropOldest(key) {
+			atomic.AddUint64(&DefaultSnmp.FragExpired, 1)
+			return nil, false
+		}
+	}
+
+	if !exists {
+		r.packets[key] = p
+	}
+	p.frags = append(p.frags, ipv4Frag{offset, append([]byte(nil), ip.Payload...)})
+	p.size += len(ip.Payload)
+	r.size += len(ip.Payload)
+	if !more {
+		p.total = end
+	}
+	if p.total < 0 || p.size < p.total {
+		return nil, false
+	}
+
+	// without overlaps, the fragments cover the whole payload
+	delete(r.packets, key)
+	r.size -= p.size
+	payload = make([]byte, p.total)
+	for _, f := range p.frags {
+		copy(payload[f.offset:], f.data)
+	}
+	atomic.AddUint64(&DefaultSnmp.FragReassembled, uint64(len(p.frags)))
+	return payload, true
+}
+
+// drop removes a datagram, counting its fragments as expired
+func (r *ipv4Reassembler) drop(key ipv4FragKey) {
+	if p, ok := r.packets[key]; ok {
+		delete(r.packets, key)
+		r.size -= p.size
+		atomic.AddUint64(&DefaultSnmp.FragExpired, uint64(len(p.frags)))
+	}
+}
+
+// dropOldest removes the datagram which started arriving first, other than
+// keep, and reports whether there was one
+func (r *ipv4Reassembler) dropOldest(keep ipv4FragKey) bool {
+	var oldest ipv4FragKey
+	var ts time.Time
+	found := false
+	for key, p := range r.packets {
+		if key != keep && (!found || p.ts.Before(ts)) {
+			oldest, ts, found = key, p.ts, true
+		}
+	}
+	if found {
+		r.drop(oldest)
+	}
+	return found
+}
+
+// expire removes the datagrams that took too long to be completed
+func (r *ipv4Reassembler) expire(now time.Time) {
+	for key, p := range r.packets {
+		if now.Sub(p.ts) >= defragTimeout {
+			r.drop(key)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package kcp
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DLT_RAW as reported by libpcap for tun devices, 14 on OpenBSD,
+	// while capture files use LINKTYPE_RAW
+	linkTypeRawDLT        layers.LinkType = 12
+	linkTypeRawDLTOpenBSD layers.LinkType = 14
+
+	// the pseudo device capturing on all interfaces on Linux
+	anyDevice = "any"
+)
+
+// linkDecoder returns the decoder of packets captured on a link of type lt,
+// ICMPConn finds the IP layer behind Ethernet, Linux cooked ("any"), BSD
+// loopback, and raw IP headers, other link types are refused.
+func linkDecoder(lt layers.LinkType) (gopacket.Decoder, error) {
+	switch lt {
+	case layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeNull, layers.LinkTypeLoop:
+		return lt, nil
+	case layers.LinkTypeRaw, linkTypeRawDLT, linkTypeRawDLTOpenBSD, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		// no link header, the IP version is told by the first nibble
+		return layers.LinkTypeRaw, nil
+	}
+	return nil, errors.Errorf("kcp: unsupported link type %d", lt)
+}
@@ -0,0 +1,13 @@
+//go:build !cgo || nopcap
+// +build !cgo nopcap
+
+package kcp
+
+// ICMPConn reads from the raw socket, which doesn't need capture devices
+const pcapCapture = false
+
+// openICMPReader reads inbound ICMP messages from the raw ICMP socket, the
+// devices and capture options are unused since the socket receives on all interfaces
+func openICMPReader(family *icmpFamily, conn icmpSocket, devices []string, opts CaptureOptions, filter icmpFilter) (icmpReader, error) {
+	return newRawReader(family, conn, filter), nil
+}
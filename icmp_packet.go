@@ -0,0 +1,191 @@
+package kcp
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetReader reads inbound ICMP messages from a gopacket packet channel,
+// filled by a live capture or by an injected ICMPTransport.Source
+type packetReader struct {
+	family  *icmpFamily
+	packets chan gopacket.Packet
+	close   func()           // stops the source of the packets, nil if not owned
+	stamped bool             // the packets carry the index of the capturing interface
+	defrag  *ipv4Reassembler // captured IPv4 fragments, nil on IPv6
+	rd      atomic.Value     // read deadline
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newPacketReader(family *icmpFamily, packets chan gopacket.Packet, close func(), stamped bool) *packetReader {
+	r := new(packetReader)
+	r.family = family
+	r.packets = packets
+	r.close = close
+	r.stamped = stamped
+	if family == icmpv4 {
+		r.defrag = newIPv4Reassembler()
+	}
+	r.die = make(chan struct{})
+	return r
+}
+
+func (r *packetReader) ReadICMP(b []byte) (int, icmpPath, error) {
+	var timeout <-chan time.Time
+	if deadline, ok := r.rd.Load().(time.Time); ok && !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		// Read in a packet from our channel
+		var packet gopacket.Packet
+		select {
+		case p, ok := <-r.packets:
+			if !ok {
+				return 0, icmpPath{}, io.EOF
+			}
+			packet = p
+		case <-timeout:
+			return 0, icmpPath{}, errTimeout{}
+		case <-r.die:
+			return 0, icmpPath{}, errors.New(errBrokenPipe)
+		}
+
+		// only trust the interface index mergePackets stamped, pcapng files
+		// number their interfaces on their own
+		ifindex := 0
+		if r.stamped {
+			ifindex = packet.Metadata().InterfaceIndex
+		}
+		switch ipPacket := packet.Layer(r.family.layer).(type) {
+		case *layers.IPv4:
+			// captures see the fragments of datagrams larger than the path MTU
+			payload := ipPacket.Payload
+			if isFragment(ipPacket) {
+				var ok bool
+				if payload, ok = r.defrag.add(ipPacket, time.Now()); !ok {
+					continue
+				}
+			}
+			return copy(b, payload), icmpPath{ipPacket.SrcIP, ipPacket.DstIP, ifindex}, nil
+		case *layers.IPv6:
+			if ipPacket.NextHeader == layers.IPProtocolICMPv6 {
+				return copy(b, ipPacket.Payload), icmpPath{ipPacket.SrcIP, ipPacket.DstIP, ifindex}, nil
+			}
+		case nil:
+			// the filter only lets IP packets through, make packets the
+			// decoder can't take apart visible
+			if packet.ErrorLayer() != nil {
+				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			}
+		}
+	}
+}
+
+// mergePackets merges the packets of several captures into one channel,
+// closed once all of them are, stamping each packet with the index of the
+// interface its capture runs on
+func mergePackets(sources []chan gopacket.Packet, ifindexes []int) chan gopacket.Packet {
+	packets := make(chan gopacket.Packet, qlen)
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(source chan gopacket.Packet, ifindex int) {
+			defer wg.Done()
+			for packet := range source {
+				packet.Metadata().InterfaceIndex = ifindex
+				packets <- packet
+			}
+		}(source, ifindexes[i])
+	}
+	go func() {
+		wg.Wait()
+		close(packets)
+	}()
+	return packets
+}
+
+func (r *packetReader) SetReadDeadline(t time.Time) error {
+	r.rd.Store(t)
+	return nil
+}
+
+// Close stops the source if the reader owns it, its goroutine exits once the
+// source reports it's closed, after the packets it's still delivering are drained
+func (r *packetReader) Close() error {
+	r.dieOnce.Do(func() {
+		close(r.die)
+		if r.close != nil {
+			r.close()
+			go func() {
+				for range r.packets {
+				}
+			}()
+		}
+	})
+	return nil
+}
+
+// PacketInjector is an in-memory packet source for ICMPTransport.Source,
+// feeding crafted IP packets to an ICMPConn without privileges or a network.
+type PacketInjector struct {
+	chPacket chan []byte
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+// NewPacketInjector creates an empty PacketInjector
+func NewPacketInjector() *PacketInjector {
+	p := new(PacketInjector)
+	p.chPacket = make(chan []byte, qlen)
+	p.die = make(chan struct{})
+	return p
+}
+
+// Inject queues an IPv4 or IPv6 packet, without a link layer header, for the
+// ICMPConn reading from the injector, blocking while the queue is full
+func (p *PacketInjector) Inject(packet []byte) error {
+	data := make([]byte, len(packet))
+	copy(data, packet)
+	select {
+	case p.chPacket <- data:
+		return nil
+	case <-p.die:
+		return errors.New(errBrokenPipe)
+	}
+}
+
+// ReadPacketData implements gopacket.PacketDataSource, it returns io.EOF once
+// the injector is closed
+func (p *PacketInjector) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case data := <-p.chPacket:
+		return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, nil
+	case <-p.die:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+// Source returns a packet source reading from the injector, suitable for
+// ICMPTransport.Source
+func (p *PacketInjector) Source() (*gopacket.PacketSource, error) {
+	return gopacket.NewPacketSource(p, layers.LinkTypeRaw), nil
+}
+
+// Close stops the injector, ending the packet sources reading from it
+func (p *PacketInjector) Close() error {
+	p.dieOnce.Do(func() {
+		close(p.die)
+	})
+	return nil
+}
@@ -0,0 +1,123 @@
+//go:build cgo && !nopcap
+// +build cgo,!nopcap
+
+package kcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	// ICMPConn captures inbound packets with pcap on its devices
+	pcapCapture = true
+
+	// default pcap read timeout, also bounds how long closing the handle
+	// waits for a blocked read
+	pcapReadTimeout = 100 * time.Millisecond
+
+	// captured bytes of each packet
+	pcapSnapLen = 2000
+)
+
+// openICMPReader captures inbound ICMP messages on devices with pcap
+func openICMPReader(family *icmpFamily, conn icmpSocket, devices []string, opts CaptureOptions, filter icmpFilter) (icmpReader, error) {
+	var handles []*pcap.Handle
+	closeAll := func() {
+		for _, handle := range handles {
+			handle.Close()
+		}
+	}
+
+	var sources []chan gopacket.Packet
+	var ifindexes []int
+	for _, dev := range devices {
+		handle, err := openPcap(dev, opts)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		handles = append(handles, handle)
+
+		// newer libpcap captures on "any" with the Linux cooked v2 header by
+		// default, which gopacket can't decode, ask for the older one
+		if dev == anyDevice {
+			handle.SetLinkType(layers.LinkTypeLinuxSLL)
+		}
+		decoder, err := linkDecoder(handle.LinkType())
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// skip our own outbound messages, the platforms which can't tell the
+		// direction filter out the ones sent from the device's addresses,
+		// which includes the messages between local peers over loopback
+		expr := family.pcapFilter(filter)
+		if err := handle.SetDirection(pcap.DirectionIn); err != nil {
+			outbound, err := outboundFilter(family, dev)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			if outbound != "" {
+				expr += " and not (" + outbound + ")"
+			}
+		}
+
+		// the filter is compiled into the kernel so unrelated traffic isn't
+		// copied to userspace
+		if err := handle.SetBPFFilter(expr); err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// pcap doesn't tell the interface a packet was captured on, but each
+		// handle captures on one, unknown for the "any" device
+		ifindex := 0
+		if ifi, err := net.InterfaceByName(dev); err == nil && dev != anyDevice {
+			ifindex = ifi.Index
+		}
+		sources = append(sources, gopacket.NewPacketSource(handle, decoder).Packets())
+		ifindexes = append(ifindexes, ifindex)
+	}
+	return newPacketReader(family, mergePackets(sources, ifindexes), closeAll, true), nil
+}
+
+// openPcap activates a non promiscuous capture on dev, in immediate mode
+// unless opts says otherwise, so packets aren't held back in the buffer
+func openPcap(dev string, opts CaptureOptions) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = pcapReadTimeout
+	}
+
+	if err := inactive.SetSnapLen(pcapSnapLen); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(false); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(timeout); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetImmediateMode(!opts.NoImmediate); err != nil {
+		return nil, err
+	}
+	if opts.BufferSize > 0 {
+		if err := inactive.SetBufferSize(opts.BufferSize); err != nil {
+			return nil, err
+		}
+	}
+	return inactive.Activate()
+}
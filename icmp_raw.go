@@ -0,0 +1,164 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// icmpSocket is an ICMP socket along with its IPv4 or IPv6 side passing
+// control messages, an unprivileged *icmp.PacketConn or a rawSocket
+type icmpSocket interface {
+	net.PacketConn
+	IPv4PacketConn() *ipv4.PacketConn
+	IPv6PacketConn() *ipv6.PacketConn
+}
+
+// rawSocket is a privileged ICMP socket, opened the way icmp.ListenPacket
+// does but keeping the socket at hand to set options like DF on
+type rawSocket struct {
+	*net.IPConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+}
+
+func listenRawSocket(family *icmpFamily, laddr string) (*rawSocket, error) {
+	conn, err := net.ListenPacket(family.network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &rawSocket{IPConn: conn.(*net.IPConn)}
+	if family == icmpv4 {
+		s.p4 = ipv4.NewPacketConn(conn)
+	} else {
+		s.p6 = ipv6.NewPacketConn(conn)
+	}
+	return s, nil
+}
+
+func (s *rawSocket) IPv4PacketConn() *ipv4.PacketConn { return s.p4 }
+func (s *rawSocket) IPv6PacketConn() *ipv6.PacketConn { return s.p6 }
+
+// ReadFrom reads an ICMP message, through the IPv4 side which strips the IP
+// header on the platforms the socket doesn't
+func (s *rawSocket) ReadFrom(b []byte) (int, net.Addr, error) {
+	if s.p4 != nil {
+		n, _, addr, err := s.p4.ReadFrom(b)
+		return n, addr, err
+	}
+	return s.IPConn.ReadFrom(b)
+}
+
+// rawReader reads inbound ICMP messages from the ICMP socket itself, a kernel
+// BPF filter keeps the messages not belonging to the tunnel out of userspace.
+type rawReader struct {
+	conn icmpSocket
+	p4   *ipv4.PacketConn // the socket's IPv4 side, nil on IPv6
+	p6   *ipv6.PacketConn // the socket's IPv6 side, nil on IPv4
+}
+
+func newRawReader(family *icmpFamily, conn icmpSocket, filter icmpFilter) *rawReader {
+	r := newPingReader(conn)
+
+	// the filter only saves copying unrelated messages, ICMPConn checks
+	// every message anyway, so platforms without socket filters go without
+	if prog, err := bpf.Assemble(rawFilter(family, filter)); err == nil {
+		if r.p4 != nil {
+			r.p4.SetBPF(prog)
+		} else if r.p6 != nil {
+			r.p6.SetBPF(prog)
+		}
+	}
+	return r
+}
+
+// newPingReader reads inbound ICMP messages from conn without a socket
+// filter, unprivileged ping sockets need none as the kernel only delivers the
+// replies to their own requests.
+func newPingReader(conn icmpSocket) *rawReader {
+	// the control messages telling where messages arrived are optional too,
+	// replies then leave the way the kernel picks
+	r := &rawReader{conn: conn, p4: conn.IPv4PacketConn(), p6: conn.IPv6PacketConn()}
+	if r.p4 != nil {
+		r.p4.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+	} else if r.p6 != nil {
+		r.p6.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+	}
+	return r
+}
+
+func (r *rawReader) ReadICMP(b []byte) (int, icmpPath, error) {
+	var n int
+	var path icmpPath
+	var addr net.Addr
+	var err error
+	switch {
+	case r.p4 != nil:
+		var cm *ipv4.ControlMessage
+		if n, cm, addr, err = r.p4.ReadFrom(b); cm != nil {
+			path.dst, path.ifindex = cm.Dst, cm.IfIndex
+		}
+	case r.p6 != nil:
+		var cm *ipv6.ControlMessage
+		if n, cm, addr, err = r.p6.ReadFrom(b); cm != nil {
+			path.dst, path.ifindex = cm.Dst, cm.IfIndex
+		}
+	default:
+		n, addr, err = r.conn.ReadFrom(b)
+	}
+	if err != nil {
+		return 0, icmpPath{}, err
+	}
+
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		path.src = a.IP
+	case *net.UDPAddr:
+		path.src = a.IP
+	}
+	return n, path, nil
+}
+
+func (r *rawReader) SetReadDeadline(t time.Time) error { return r.conn.SetReadDeadline(t) }
+
+// Close is a no-op, ReadICMP is unblocked when ICMPConn closes the socket
+func (r *rawReader) Close() error { return nil }
+
+// rawFilter returns a socket filter accepting the ICMP messages selected by filter
+func rawFilter(family *icmpFamily, filter icmpFilter) []bpf.Instruction {
+	type check struct {
+		off  uint32 // offset in the ICMP message
+		size int
+		val  uint32
+	}
+	checks := []check{{0, 1, uint32(filter.typ)}}
+	if filter.id != anyEchoID {
+		checks = append(checks, check{filter.idOffset, 2, uint32(filter.id)})
+	}
+
+	var prog []bpf.Instruction
+	if family == icmpv4 {
+		// IPv4 raw sockets see the IP header, check the source address
+		// and set X = header length, IPv6 ones only see the message
+		if src := filter.src.To4(); src != nil {
+			prog = append(prog,
+				bpf.LoadAbsolute{Off: 12, Size: 4},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: binary.BigEndian.Uint32(src), SkipTrue: uint8(2*len(checks) + 2)})
+		}
+		prog = append(prog, bpf.LoadMemShift{Off: 0})
+	}
+	for k, c := range checks {
+		if family == icmpv4 {
+			prog = append(prog, bpf.LoadIndirect{Off: c.off, Size: c.size})
+		} else {
+			prog = append(prog, bpf.LoadAbsolute{Off: c.off, Size: c.size})
+		}
+		// on mismatch, skip the remaining checks and the accept
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: c.val, SkipTrue: uint8(2*(len(checks)-k-1) + 1)})
+	}
+	return append(prog, bpf.RetConstant{Val: icmpReadBufferSize}, bpf.RetConstant{Val: 0})
+}
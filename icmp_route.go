@@ -0,0 +1,176 @@
+package kcp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// routeEntry is a route of the kernel routing table
+type routeEntry struct {
+	dst      *net.IPNet
+	ifindex  int    // outbound interface
+	priority uint32 // lower is preferred
+	local    bool   // destinations on this host, reached over loopback
+}
+
+// matchRoute returns the route packets to dst take, the longest matching
+// prefix with the lowest priority, nil if there's none
+func matchRoute(routes []routeEntry, dst net.IP) *routeEntry {
+	var best *routeEntry
+	bestLen := -1
+	for k := range routes {
+		r := &routes[k]
+		if !r.dst.Contains(dst) {
+			continue
+		}
+		ones, _ := r.dst.Mask.Size()
+		if ones > bestLen || (ones == bestLen && (r.local || (!best.local && r.priority < best.priority))) {
+			best, bestLen = r, ones
+		}
+	}
+	return best
+}
+
+// captureDevices returns the interfaces an ICMPConn captures inbound packets
+// on, devs if set, otherwise the interface of the route to the remote address
+// for clients, and for listeners the interface holding laddr, or all the up
+// interfaces with addresses of the family.
+func captureDevices(family *icmpFamily, devs []string, laddr string, remote *ICMPAddr) ([]string, error) {
+	if len(devs) > 0 {
+		return devs, nil
+	}
+
+	if remote != nil {
+		ifi, err := routeInterface(remote.IP)
+		if err != nil {
+			return nil, err
+		}
+		return []string{ifi.Name}, nil
+	}
+
+	if ip := net.ParseIP(laddr); ip != nil && !ip.IsUnspecified() {
+		ifi, err := interfaceWithAddr(ip)
+		if err != nil {
+			return nil, err
+		}
+		return []string{ifi.Name}, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "net.Interfaces")
+	}
+	var devices []string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && icmpFamilyOf(ipnet.IP) == family {
+				devices = append(devices, ifi.Name)
+				break
+			}
+		}
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("kcp: no interface to capture on")
+	}
+	return devices, nil
+}
+
+// interfaceWithAddr returns the interface holding the address ip
+func interfaceWithAddr(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "net.Interfaces")
+	}
+	for k := range ifaces {
+		addrs, err := ifaces[k].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[k], nil
+			}
+		}
+	}
+	return nil, errors.Errorf("kcp: no interface with address %v", ip)
+}
+
+// loopbackInterface returns the loopback interface of the host
+func loopbackInterface() (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "net.Interfaces")
+	}
+	for k := range ifaces {
+		if ifaces[k].Flags&net.FlagLoopback != 0 {
+			return &ifaces[k], nil
+		}
+	}
+	return nil, errors.New("kcp: no loopback interface")
+}
+
+// routeInterfaceBySource finds the outbound interface to dst from the source
+// address the kernel picks for it, on platforms without a routing table reader
+func routeInterfaceBySource(dst net.IP) (*net.Interface, error) {
+	src, err := sourceAddr(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	// packets to the host itself go over loopback
+	if src.Equal(dst) || dst.IsLoopback() {
+		return loopbackInterface()
+	}
+	return interfaceWithAddr(src)
+}
+
+// sourceAddr returns the local address the kernel sends packets to dst from,
+// connecting a UDP socket sends nothing
+func sourceAddr(dst net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, errors.Wrap(err, "net.DialUDP")
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// outboundFilter returns the pcap filter expression matching the packets of
+// the family sent from the addresses of dev, or of every interface for the
+// "any" device, empty if it has none
+func outboundFilter(family *icmpFamily, dev string) (string, error) {
+	var addrs []net.Addr
+	if dev == anyDevice {
+		var err error
+		if addrs, err = net.InterfaceAddrs(); err != nil {
+			return "", errors.Wrap(err, "net.InterfaceAddrs")
+		}
+	} else {
+		ifi, err := net.InterfaceByName(dev)
+		if err != nil {
+			return "", errors.Wrap(err, "net.InterfaceByName")
+		}
+		if addrs, err = ifi.Addrs(); err != nil {
+			return "", errors.Wrap(err, "net.Interface.Addrs")
+		}
+	}
+
+	var expr string
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && icmpFamilyOf(ipnet.IP) == family {
+			if expr != "" {
+				expr += " or "
+			}
+			expr += "src host " + ipnet.IP.String()
+		}
+	}
+	return expr, nil
+}
@@ -0,0 +1,113 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// size of struct rtmsg preceding the attributes of a route message
+const sizeofRtMsg = 12
+
+// byte order of netlink attribute integers
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// routeInterface returns the interface packets to dst leave on, looked up in
+// the routing tables dumped over netlink
+func routeInterface(dst net.IP) (*net.Interface, error) {
+	family := syscall.AF_INET6
+	if dst.To4() != nil {
+		family = syscall.AF_INET
+	}
+
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return routeInterfaceBySource(dst)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return routeInterfaceBySource(dst)
+	}
+
+	r := matchRoute(parseRoutes(msgs, family), dst)
+	if r == nil {
+		return nil, errors.Errorf("kcp: no route to %v", dst)
+	}
+	if r.local {
+		return loopbackInterface()
+	}
+	ifi, err := net.InterfaceByIndex(r.ifindex)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.InterfaceByIndex")
+	}
+	return ifi, nil
+}
+
+// parseRoutes takes the unicast and local routes of the family out of a
+// netlink route dump, routes of policy routing tables are left out as only
+// the main and local tables apply to every packet
+func parseRoutes(msgs []syscall.NetlinkMessage, family int) []routeEntry {
+	var routes []routeEntry
+	for k := range msgs {
+		m := &msgs[k]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < sizeofRtMsg || int(m.Data[0]) != family {
+			continue
+		}
+		dstLen, table, typ := int(m.Data[1]), uint32(m.Data[4]), m.Data[7]
+		if typ != syscall.RTN_UNICAST && typ != syscall.RTN_LOCAL {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			continue
+		}
+
+		bits := 8 * net.IPv6len
+		dst := make(net.IP, net.IPv6len)
+		if family == syscall.AF_INET {
+			bits = 8 * net.IPv4len
+			dst = make(net.IP, net.IPv4len)
+		}
+		r := routeEntry{local: typ == syscall.RTN_LOCAL}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				copy(dst, attr.Value)
+			case syscall.RTA_OIF:
+				if len(attr.Value) >= 4 {
+					r.ifindex = int(nativeEndian.Uint32(attr.Value))
+				}
+			case syscall.RTA_MULTIPATH:
+				// multipath routes have their interfaces in the nexthops,
+				// take the first one's
+				if len(attr.Value) >= syscall.SizeofRtNexthop && r.ifindex == 0 {
+					r.ifindex = int(nativeEndian.Uint32(attr.Value[4:]))
+				}
+			case syscall.RTA_TABLE:
+				// tables above 255 only fit in the attribute
+				if len(attr.Value) >= 4 {
+					table = nativeEndian.Uint32(attr.Value)
+				}
+			case syscall.RTA_PRIORITY:
+				if len(attr.Value) >= 4 {
+					r.priority = nativeEndian.Uint32(attr.Value)
+				}
+			}
+		}
+		if table != syscall.RT_TABLE_MAIN && table != syscall.RT_TABLE_LOCAL {
+			continue
+		}
+		r.dst = &net.IPNet{IP: dst, Mask: net.CIDRMask(dstLen, bits)}
+		routes = append(routes, r)
+	}
+	return routes
+}
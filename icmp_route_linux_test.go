@@ -0,0 +1,60 @@
+package kcp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	route := func(dst string, table uint8, attrs ...[]byte) syscall.NetlinkMessage {
+		_, ipnet, _ := net.ParseCIDR(dst)
+		ones, _ := ipnet.Mask.Size()
+		data := make([]byte, sizeofRtMsg)
+		data[0], data[1], data[4], data[7] = syscall.AF_INET, byte(ones), table, syscall.RTN_UNICAST
+		attrs = append(attrs, rtattr(syscall.RTA_DST, ipnet.IP.To4()))
+		for _, a := range attrs {
+			data = append(data, a...)
+		}
+		return syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWROUTE}, Data: data}
+	}
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		nativeEndian.PutUint32(b, v)
+		return b
+	}
+	nexthop := func(ifindex uint32) []byte {
+		b := make([]byte, syscall.SizeofRtNexthop)
+		nativeEndian.PutUint16(b, syscall.SizeofRtNexthop)
+		nativeEndian.PutUint32(b[4:], ifindex)
+		return b
+	}
+
+	msgs := []syscall.NetlinkMessage{
+		route("0.0.0.0/0", syscall.RT_TABLE_MAIN, rtattr(syscall.RTA_OIF, u32(2))),
+		// policy routing tables, named in the header or the attribute
+		route("192.0.2.0/24", 100, rtattr(syscall.RTA_OIF, u32(3))),
+		route("192.0.2.0/25", syscall.RT_TABLE_COMPAT, rtattr(syscall.RTA_TABLE, u32(1000)), rtattr(syscall.RTA_OIF, u32(3))),
+		// an ECMP route
+		route("198.51.100.0/24", syscall.RT_TABLE_MAIN, rtattr(syscall.RTA_MULTIPATH, append(nexthop(4), nexthop(5)...))),
+	}
+	routes := parseRoutes(msgs, syscall.AF_INET)
+	if len(routes) != 2 {
+		t.Fatal("unexpected routes", routes)
+	}
+	if r := matchRoute(routes, net.ParseIP("192.0.2.1")); r == nil || r.ifindex != 2 {
+		t.Fatal("policy routing table route used", r)
+	}
+	if r := matchRoute(routes, net.ParseIP("198.51.100.1")); r == nil || r.ifindex != 4 {
+		t.Fatal("multipath route without the first nexthop's interface", r)
+	}
+}
+
+// rtattr encodes a route attribute
+func rtattr(typ uint16, value []byte) []byte {
+	b := make([]byte, (syscall.SizeofRtAttr+len(value)+syscall.RTA_ALIGNTO-1)&^(syscall.RTA_ALIGNTO-1))
+	nativeEndian.PutUint16(b, uint16(syscall.SizeofRtAttr+len(value)))
+	nativeEndian.PutUint16(b[2:], typ)
+	copy(b[syscall.SizeofRtAttr:], value)
+	return b
+}
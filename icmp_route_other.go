@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package kcp
+
+import "net"
+
+// routeInterface returns the interface packets to dst leave on
+func routeInterface(dst net.IP) (*net.Interface, error) {
+	return routeInterfaceBySource(dst)
+}
@@ -0,0 +1,194 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// payload size of the echo messages sent by ping by default
+	shapePayloadSize = 56
+
+	// size of the struct timeval ping puts at the start of its payloads
+	shapeTimestampSize = 16
+
+	// size of the fragment header, packet id, fragment index, fragment count
+	// and the size of the fragment's chunk of the packet
+	shapeHeaderSize = 5
+
+	// bytes of a packet carried by each fragment
+	shapeChunkSize = shapePayloadSize - shapeTimestampSize - icmpTagSize - shapeHeaderSize
+
+	// maximum fragments of a packet
+	shapeMaxFragments = 255
+
+	// maximum packets being reassembled at once, and how long a packet
+	// may take to be completed
+	shapeMaxPending  = 256
+	shapeFragTimeout = 5 * time.Second
+
+	// maximum messages waiting to be paced, the packets not fitting are
+	// dropped, KCP retransmits them just like lost packets
+	shapeMaxQueue = 256
+)
+
+var errShapeTooLarge = errors.New("kcp: packet too large to be shaped")
+
+// shapeFragments splits a packet into the fragment payloads of shaped echo
+// messages, empty packets are sent as a single empty fragment
+func shapeFragments(id uint16, b []byte) ([][]byte, error) {
+	count := (len(b) + shapeChunkSize - 1) / shapeChunkSize
+	if count == 0 {
+		count = 1
+	}
+	if count > shapeMaxFragments {
+		return nil, errShapeTooLarge
+	}
+
+	frags := make([][]byte, count)
+	for k := range frags {
+		chunk := b[k*shapeChunkSize:]
+		if len(chunk) > shapeChunkSize {
+			chunk = chunk[:shapeChunkSize]
+		}
+		frag := make([]byte, shapeHeaderSize+len(chunk))
+		binary.BigEndian.PutUint16(frag, id)
+		frag[2] = byte(k)
+		frag[3] = byte(count)
+		frag[4] = byte(len(chunk))
+		copy(frag[shapeHeaderSize:], chunk)
+		frags[k] = frag
+	}
+	return frags, nil
+}
+
+// shapePayload builds the payload of a shaped echo message, laid out like the
+// ones ping sends, a timestamp followed by the tag, the fragment, and the
+// byte pattern ping fills the rest of the payload with
+func shapePayload(tag, frag []byte, now time.Time) []byte {
+	data := make([]byte, shapePayloadSize)
+	binary.LittleEndian.PutUint64(data, uint64(now.Unix()))
+	binary.LittleEndian.PutUint64(data[8:], uint64(now.Nanosecond()/1000))
+	n := shapeTimestampSize
+	n += copy(data[n:], tag)
+	n += copy(data[n:], frag)
+	for ; n < len(data); n++ {
+		data[n] = byte(n)
+	}
+	return data
+}
+
+type (
+	// shapeReassembler puts shaped packets back together from their fragments
+	shapeReassembler struct {
+		packets map[shapeKey]*shapePacket
+	}
+
+	// shapeKey identifies a packet being reassembled
+	shapeKey struct {
+		src string
+		id  uint16
+	}
+
+	// shapePacket is a packet being reassembled
+	shapePacket struct {
+		chunks   [][]byte
+		received int
+		ts       time.Time // arrival of the first fragment
+	}
+)
+
+func newShapeReassembler() *shapeReassembler {
+	r := new(shapeReassembler)
+	r.packets = make(map[shapeKey]*shapePacket)
+	return r
+}
+
+// add records a fragment from src, and returns the packet once all of its
+// fragments arrived, malformed fragments are ignored
+func (r *shapeReassembler) add(src string, frag []byte, now time.Time) (packet []byte, ok bool) {
+	if len(frag) < shapeHeaderSize {
+		return nil, false
+	}
+	index, count, size := int(frag[2]), int(frag[3]), int(frag[4])
+	if index >= count || size > shapeChunkSize || len(frag) < shapeHeaderSize+size {
+		return nil, false
+	}
+	chunk := frag[shapeHeaderSize : shapeHeaderSize+size]
+
+	// single fragment packets are the common case for small packets
+	if count == 1 {
+		return append([]byte(nil), chunk...), true
+	}
+
+	key := shapeKey{src, binary.BigEndian.Uint16(frag)}
+	p, exists := r.packets[key]
+	if exists && (len(p.chunks) != count || now.Sub(p.ts) >= shapeFragTimeout) {
+		delete(r.packets, key)
+		exists = false
+	}
+	if !exists {
+		if len(r.packets) >= shapeMaxPending {
+			r.expire(now)
+			if len(r.packets) >= shapeMaxPending {
+				return nil, false
+			}
+		}
+		p = &shapePacket{chunks: make([][]byte, count), ts: now}
+		r.packets[key] = p
+	}
+
+	if p.chunks[index] == nil {
+		p.chunks[index] = append([]byte(nil), chunk...)
+		p.received++
+	}
+	if p.received < count {
+		return nil, false
+	}
+
+	delete(r.packets, key)
+	for _, c := range p.chunks {
+		packet = append(packet, c...)
+	}
+	return packet, true
+}
+
+// expire removes the packets that took too long to be completed
+func (r *shapeReassembler) expire(now time.Time) {
+	for key, p := range r.packets {
+		if now.Sub(p.ts) >= shapeFragTimeout {
+			delete(r.packets, key)
+		}
+	}
+}
+
+// shapedMessage is a tunnel message waiting for its turn to be sent
+type shapedMessage struct {
+	dst *ICMPAddr
+	seq uint16
+	msg []byte
+}
+
+// shaper sends the queued messages ShapeInterval apart, so writers never
+// wait for their turn, which would hold the session lock they write under
+func (c *ICMPConn) shaper() {
+	timer := time.NewTimer(c.shapeInterval)
+	timer.Stop()
+	for {
+		select {
+		case m := <-c.chShaped:
+			c.sendEcho(m.dst, m.seq, m.msg)
+		case <-c.die:
+			return
+		}
+
+		timer.Reset(c.shapeInterval)
+		select {
+		case <-timer.C:
+		case <-c.die:
+			return
+		}
+	}
+}
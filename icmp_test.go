@@ -0,0 +1,1090 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestICMPFamily(t *testing.T) {
+	if icmpFamilyOf(nil) != icmpv4 {
+		t.Fatal("unspecified address should use ICMP")
+	}
+	if icmpFamilyOf(net.ParseIP("192.0.2.1")) != icmpv4 {
+		t.Fatal("IPv4 address should use ICMP")
+	}
+	if icmpFamilyOf(net.ParseIP("2001:db8::1")) != icmpv6 {
+		t.Fatal("IPv6 address should use ICMPv6")
+	}
+
+	tr := new(ICMPTransport)
+	if n := tr.Overhead(&net.IPAddr{IP: net.ParseIP("2001:db8::1")}); n != 52 {
+		t.Fatal("ICMPv6 overhead", n)
+	}
+	if n := tr.Overhead(&net.IPAddr{IP: net.ParseIP("192.0.2.1")}); n != 32 {
+		t.Fatal("ICMP overhead", n)
+	}
+}
+
+func TestEchoID(t *testing.T) {
+	fixed := &ICMPTransport{EchoIDMode: EchoIDFixed, EchoID: 4242}
+	if id, shared := fixed.echoID(); id != 4242 || !shared {
+		t.Fatal("fixed echo id", id, shared)
+	}
+
+	keyed := &ICMPTransport{EchoIDMode: EchoIDKeyed, EchoIDKey: []byte("secret")}
+	id1, shared := keyed.echoID()
+	id2, _ := (&ICMPTransport{EchoIDMode: EchoIDKeyed, EchoIDKey: []byte("secret")}).echoID()
+	if id1 != id2 || !shared {
+		t.Fatal("keyed echo id is not deterministic", id1, id2)
+	}
+
+	if _, shared := new(ICMPTransport).echoID(); shared {
+		t.Fatal("random echo id must not be shared")
+	}
+
+	addr := &ICMPAddr{IP: net.ParseIP("192.0.2.1"), ID: 7}
+	if addr.String() != "192.0.2.1#7" {
+		t.Fatal("unexpected address format", addr)
+	}
+}
+
+func TestRawFilter(t *testing.T) {
+	echo := func(typ icmp.Type, id int) []byte {
+		b, _ := (&icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Data: []byte("kcp")}}).Marshal(nil)
+		return b
+	}
+	ipv4Header := make([]byte, ipv4.HeaderLen)
+	ipv4Header[0] = 0x45
+	copy(ipv4Header[12:], net.ParseIP("192.0.2.1").To4())
+	peer, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.9")
+
+	cases := []struct {
+		family *icmpFamily
+		src    net.IP
+		id     int
+		packet []byte
+		accept bool
+	}{
+		{icmpv4, nil, 42, append(ipv4Header, echo(ipv4.ICMPTypeEcho, 42)...), true},
+		{icmpv4, nil, 42, append(ipv4Header, echo(ipv4.ICMPTypeEcho, 43)...), false},
+		{icmpv4, nil, 42, append(ipv4Header, echo(ipv4.ICMPTypeEchoReply, 42)...), false},
+		{icmpv4, nil, anyEchoID, append(ipv4Header, echo(ipv4.ICMPTypeEcho, 43)...), true},
+		{icmpv4, peer, 42, append(ipv4Header, echo(ipv4.ICMPTypeEcho, 42)...), true},
+		{icmpv4, other, 42, append(ipv4Header, echo(ipv4.ICMPTypeEcho, 42)...), false},
+		{icmpv4, other, anyEchoID, append(ipv4Header, echo(ipv4.ICMPTypeEcho, 42)...), false},
+		{icmpv6, nil, 42, echo(ipv6.ICMPTypeEchoRequest, 42), true},
+		{icmpv6, nil, 42, echo(ipv6.ICMPTypeEchoRequest, 43), false},
+	}
+	for k, c := range cases {
+		vm, err := bpf.NewVM(rawFilter(c.family, icmpFilter{c.src, c.family.typeNumber(c.family.echoRequest), c.id, 4}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := vm.Run(c.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (n > 0) != c.accept {
+			t.Fatal("case", k, "unexpected filter result", n)
+		}
+	}
+}
+
+func TestPCAPFilter(t *testing.T) {
+	cases := []struct {
+		family *icmpFamily
+		filter icmpFilter
+		expr   string
+	}{
+		{icmpv4, icmpFilter{nil, 8, anyEchoID, 4}, "icmp and (ip[6:2] & 0x1fff != 0 or (icmp[0:1] == 8))"},
+		{icmpv4, icmpFilter{net.ParseIP("192.0.2.1"), 0, 42, 4}, "icmp and src host 192.0.2.1 and (ip[6:2] & 0x1fff != 0 or (icmp[0:1] == 0 and icmp[4:2] == 42))"},
+		{icmpv6, icmpFilter{net.ParseIP("2001:db8::1"), 129, 42, 4}, "icmp6 and src host 2001:db8::1 and ip6[40:1] == 129 and ip6[44:2] == 42"},
+	}
+	for _, c := range cases {
+		if expr := c.family.pcapFilter(c.filter); expr != c.expr {
+			t.Fatalf("got filter %q, want %q", expr, c.expr)
+		}
+	}
+}
+
+func TestEchoBudgetQueue(t *testing.T) {
+	c := &ICMPConn{family: icmpv4, sendReplies: true, budget: 4, peers: make(map[string]*echoPeer)}
+	client := &ICMPAddr{IP: net.ParseIP("192.0.2.1"), ID: 7}
+
+	// no outstanding request, the packet waits
+	if n, err := c.queueReply([]byte("kcp"), client); err != nil || n != 3 {
+		t.Fatal("queueReply", n, err)
+	}
+	peer := c.peers[client.String()]
+	if peer == nil || len(peer.queue) != 1 {
+		t.Fatal("packet not queued")
+	}
+	for i := 0; i < echoMaxQueue+10; i++ {
+		c.queueReply([]byte("kcp"), client)
+	}
+	if len(peer.queue) != echoMaxQueue {
+		t.Fatal("queue not bounded", len(peer.queue))
+	}
+
+	// stale requests are skipped
+	now := time.Now()
+	peer.requests = []echoRequest{{1, now.Add(-2 * echoRequestTimeout)}, {2, now}, {3, now}}
+	if seq, ok := peer.takeRequest(now); !ok || seq != 2 {
+		t.Fatal("takeRequest", seq, ok)
+	}
+	if seq, ok := peer.takeRequest(now); !ok || seq != 3 {
+		t.Fatal("takeRequest", seq, ok)
+	}
+	if _, ok := peer.takeRequest(now); ok {
+		t.Fatal("takeRequest on no outstanding requests")
+	}
+}
+
+// fakeReader feeds crafted ICMP messages to an ICMPConn
+type fakeReader struct {
+	src      net.IP
+	messages [][]byte
+}
+
+func (r *fakeReader) ReadICMP(b []byte) (int, icmpPath, error) {
+	if len(r.messages) == 0 {
+		return 0, icmpPath{}, io.EOF
+	}
+	n := copy(b, r.messages[0])
+	r.messages = r.messages[1:]
+	return n, icmpPath{src: r.src}, nil
+}
+
+func (r *fakeReader) SetReadDeadline(t time.Time) error { return nil }
+func (r *fakeReader) Close() error                      { return nil }
+
+func TestReflectedEchoReply(t *testing.T) {
+	requestTag, replyTag := new(ICMPTransport).tags()
+	cases := []struct {
+		family  *icmpFamily
+		carrier Carrier
+	}{
+		{icmpv4, CarrierEcho},
+		{icmpv4, CarrierTimestamp},
+		{icmpv4, CarrierUnreachable},
+		{icmpv6, CarrierEcho},
+		{icmpv6, CarrierUnreachable},
+	}
+	for _, tc := range cases {
+		carrier, err := tc.family.carrier(tc.carrier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := net.ParseIP("192.0.2.1")
+		reply := func(tag []byte, data string) []byte {
+			msg := []byte{byte(tc.family.typeNumber(carrier.reply)), byte(carrier.code), 0, 0}
+			return append(msg, carrier.marshal(7, 1, append(append([]byte{}, tag...), data...), time.Now(), nil, server)...)
+		}
+		c := &ICMPConn{
+			family:  tc.family,
+			carrier: carrier,
+			remote:  &ICMPAddr{IP: server, ID: 7},
+			id:      7,
+			inTag:   replyTag,
+			outTag:  requestTag,
+			rbuf:    make([]byte, icmpReadBufferSize),
+			reader: &fakeReader{server, [][]byte{
+				reply(requestTag, "reflected"),
+				reply(nil, "ping"),
+				reply(replyTag, "kcp"),
+			}},
+		}
+
+		reflected := atomic.LoadUint64(&DefaultSnmp.ICMPReflected)
+		buf := make([]byte, 64)
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(tc.carrier, err)
+		}
+		if string(buf[:n]) != "kcp" || from.(*ICMPAddr).ID != 7 {
+			t.Fatal(tc.carrier, "unexpected payload", string(buf[:n]), from)
+		}
+		if atomic.LoadUint64(&DefaultSnmp.ICMPReflected) != reflected+1 {
+			t.Fatal(tc.carrier, "reflected reply not counted")
+		}
+
+		// the raw socket filter finds the identifier
+		if tc.family == icmpv4 {
+			vm, err := bpf.NewVM(rawFilter(tc.family, icmpFilter{nil, tc.family.typeNumber(carrier.reply), 7, carrier.idOffset}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipv4Header := make([]byte, ipv4.HeaderLen)
+			ipv4Header[0] = 0x45
+			if n, _ := vm.Run(append(ipv4Header, reply(replyTag, "kcp")...)); n == 0 {
+				t.Fatal(tc.carrier, "filter drops tunnel message")
+			}
+		}
+	}
+
+	if _, err := icmpv6.carrier(CarrierTimestamp); err == nil {
+		t.Fatal("ICMPv6 has no timestamp messages")
+	}
+}
+
+func TestUnreachableQuote(t *testing.T) {
+	local, peer := net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.1")
+	carrier, _ := icmpv4.carrier(CarrierUnreachable)
+	b1 := carrier.marshal(7, 1, []byte("kcp"), time.Now(), local, peer)
+	b2 := carrier.marshal(7, 2, []byte("kcp"), time.Now(), local, peer)
+
+	// the quoted datagram is the same for every message of a peer, from the
+	// peer to the local address, with a valid header checksum
+	quoted := b1[4 : 4+ipv4.HeaderLen+udpHeaderSize]
+	if !bytes.Equal(quoted, b2[4:4+ipv4.HeaderLen+udpHeaderSize]) {
+		t.Fatal("quoted datagram changes with the sequence number")
+	}
+	h, err := ipv4.ParseHeader(quoted[:ipv4.HeaderLen])
+	if err != nil || !h.Src.Equal(peer) || !h.Dst.Equal(local) {
+		t.Fatal("unexpected quoted addresses", h, err)
+	}
+	if ipv4Checksum(quoted[:ipv4.HeaderLen]) != 0 {
+		t.Fatal("bad quoted header checksum")
+	}
+	udp := quoted[ipv4.HeaderLen:]
+	if binary.BigEndian.Uint16(udp) != 7 || binary.BigEndian.Uint16(udp[2:]) != unreachablePort {
+		t.Fatal("unexpected quoted ports", udp[:4])
+	}
+	if id, seq, data, ok := carrier.parse(b2); !ok || id != 7 || seq != 2 || string(data) != "kcp" {
+		t.Fatal("parse", id, seq, string(data), ok)
+	}
+}
+
+func TestPingRateLimit(t *testing.T) {
+	c := &ICMPConn{pingRateLimit: 3}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !c.pingAllowed(now) {
+			t.Fatal("ping reply", i, "should be allowed")
+		}
+	}
+	if c.pingAllowed(now.Add(500 * time.Millisecond)) {
+		t.Fatal("ping reply over the limit should be dropped")
+	}
+	if !c.pingAllowed(now.Add(time.Second)) {
+		t.Fatal("ping reply in a new window should be allowed")
+	}
+
+	if !new(ICMPConn).pingAllowed(now) {
+		t.Fatal("ping replies should be unlimited by default")
+	}
+}
+
+func TestPingReplies(t *testing.T) {
+	requestTag, _ := new(ICMPTransport).tags()
+	ping, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 9, Seq: 1, Data: []byte("ping")}}).Marshal(nil)
+	tunnel, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 7, Data: append(requestTag, "kcp"...)}}).Marshal(nil)
+
+	// the kernel answers pings unless told not to, listeners only do when asked
+	for _, enable := range []bool{false, true} {
+		injector := NewPacketInjector()
+		for _, msg := range [][]byte{ping, tunnel} {
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("192.0.2.2")}
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, gopacket.Payload(msg)); err != nil {
+				t.Fatal(err)
+			}
+			injector.Inject(buf.Bytes())
+		}
+		output, err := newMemTransport().Listen("output")
+		if err != nil {
+			t.Fatal(err)
+		}
+		timed := &timedConn{output, make(chan time.Time, 4)}
+		conn, err := dialICMPConn(&ICMPTransport{Source: injector.Source, Output: timed, PingReplies: enable}, icmpv4, "", nil, anyEchoID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 64)
+		if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "kcp" {
+			t.Fatal("unexpected payload", string(buf[:n]), err)
+		}
+		want := 0
+		if enable {
+			want = 1
+		}
+		if replies := len(timed.writes); replies != want {
+			t.Fatal("ping replies", replies, "with PingReplies", enable)
+		}
+		conn.Close()
+		output.Close()
+		injector.Close()
+	}
+}
+
+func TestShapeFragments(t *testing.T) {
+	packet := make([]byte, 1400)
+	for k := range packet {
+		packet[k] = byte(k * 7)
+	}
+
+	frags, err := shapeFragments(42, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) != (len(packet)+shapeChunkSize-1)/shapeChunkSize {
+		t.Fatal("unexpected fragment count", len(frags))
+	}
+
+	tag, _ := new(ICMPTransport).tags()
+	c := &ICMPConn{shape: true}
+	r := newShapeReassembler()
+	now := time.Now()
+	// deliver out of order with a duplicate
+	frags = append([][]byte{frags[1], frags[1], frags[0]}, frags[2:]...)
+	for k, frag := range frags {
+		payload := shapePayload(tag, frag, now)
+		if len(payload) != shapePayloadSize {
+			t.Fatal("unexpected payload size", len(payload))
+		}
+		gotTag, msg := c.untag(payload)
+		if !bytes.Equal(gotTag, tag) {
+			t.Fatal("tag not found in shaped payload")
+		}
+		got, ok := r.add("192.0.2.1#7", msg, now)
+		if ok != (k == len(frags)-1) {
+			t.Fatal("fragment", k, "unexpected completion", ok)
+		}
+		if ok && !bytes.Equal(got, packet) {
+			t.Fatal("reassembled packet differs")
+		}
+	}
+	if len(r.packets) != 0 {
+		t.Fatal("completed packet not removed")
+	}
+
+	// empty packets for budget mode polls
+	frags, _ = shapeFragments(43, nil)
+	if got, ok := r.add("192.0.2.1#7", frags[0], now); !ok || len(got) != 0 {
+		t.Fatal("empty packet not reassembled")
+	}
+
+	// incomplete packets expire
+	frags, _ = shapeFragments(44, packet)
+	r.add("192.0.2.1#7", frags[0], now)
+	r.expire(now.Add(shapeFragTimeout))
+	if len(r.packets) != 0 {
+		t.Fatal("incomplete packet not expired")
+	}
+
+	if _, err := shapeFragments(45, make([]byte, shapeChunkSize*shapeMaxFragments+1)); err == nil {
+		t.Fatal("oversized packet should not be shaped")
+	}
+}
+
+func TestICMPConnDeadline(t *testing.T) {
+	conn, _, err := new(ICMPTransport).Dial("127.0.0.1")
+	if err != nil {
+		t.Skip("ICMP sockets unavailable:", err)
+	}
+	// the raw socket read without pcap isn't bound to the route's interface
+	if devices := conn.(*ICMPConn).Devices(); (len(devices) == 1) != pcapCapture {
+		t.Fatal("unexpected capture devices", devices)
+	}
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(buf); err == nil {
+		t.Fatal("ReadFrom should time out")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("ReadFrom should fail with a timeout", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	chErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(buf)
+		chErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-chErr:
+		if err == nil {
+			t.Fatal("ReadFrom should fail after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close does not unblock ReadFrom")
+	}
+	if conn.Close() == nil {
+		t.Fatal("second Close should fail")
+	}
+}
+
+func TestICMPSharedOutputDeadline(t *testing.T) {
+	injector := NewPacketInjector()
+	defer injector.Close()
+	output, err := newMemTransport().Listen("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	// two connections sending through the same output
+	tr := &ICMPTransport{Source: injector.Source, Output: output}
+	var conns []*ICMPConn
+	for k := 0; k < 2; k++ {
+		conn, err := dialICMPConn(tr, icmpv4, "", nil, anyEchoID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// a deadline on one doesn't time out the other's writes
+	dst := &ICMPAddr{IP: net.ParseIP("192.0.2.1"), ID: 7}
+	conns[0].SetDeadline(time.Now().Add(-time.Second))
+	if _, err := conns[0].WriteTo([]byte("kcp"), dst); err == nil {
+		t.Fatal("WriteTo past the deadline succeeded")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("WriteTo should fail with a timeout", err)
+	}
+	if _, err := conns[1].WriteTo([]byte("kcp"), dst); err != nil {
+		t.Fatal("deadline leaked to the shared output", err)
+	}
+	conns[0].SetWriteDeadline(time.Time{})
+	if _, err := conns[0].WriteTo([]byte("kcp"), dst); err != nil {
+		t.Fatal("WriteTo after clearing the deadline", err)
+	}
+
+	// listeners don't know which identifier a plain IP address uses
+	if _, err := conns[0].WriteTo([]byte("kcp"), &net.IPAddr{IP: dst.IP}); err == nil {
+		t.Fatal("listener wrote to an *net.IPAddr")
+	}
+}
+
+func TestICMPOutputWithoutSource(t *testing.T) {
+	output, err := newMemTransport().Listen("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	// without a source the output is ignored, the connection opens its own
+	// socket, and closes it
+	conn, _, err := (&ICMPTransport{Output: output}).Dial("127.0.0.1")
+	if err != nil {
+		t.Skip("ICMP sockets unavailable:", err)
+	}
+	if conn.(*ICMPConn).conn == output {
+		t.Fatal("output used without a source")
+	}
+	chErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 1500))
+		chErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-chErr:
+	case <-time.After(time.Second):
+		t.Fatal("Close does not unblock ReadFrom")
+	}
+	if _, err := output.WriteTo([]byte("kcp"), memAddr("nobody")); err != nil {
+		t.Fatal("output closed along with the connection", err)
+	}
+}
+
+func TestICMPPacketSource(t *testing.T) {
+	// a KCP packet wrapped in an echo request, as captured on the wire
+	var pkt []byte
+	kcp := NewKCP(1, func(buf []byte, size int) {
+		pkt = append([]byte(nil), buf[:size]...)
+	})
+	kcp.NoDelay(1, 10, 2, 1)
+	kcp.Send([]byte("hello"))
+	kcp.flush(false)
+
+	requestTag, _ := new(ICMPTransport).tags()
+	msg, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 7, Data: append(requestTag, pkt...)}}).Marshal(nil)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("192.0.2.2")}
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	raw, frame := gopacket.NewSerializeBuffer(), gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(raw, opts, ip, gopacket.Payload(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gopacket.SerializeLayers(frame, opts, eth, ip, gopacket.Payload(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an injected packet, and a replayed capture file
+	injector := NewPacketInjector()
+	defer injector.Close()
+	injector.Inject(raw.Bytes())
+
+	var capture bytes.Buffer
+	w := pcapgo.NewWriter(&capture)
+	w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame.Bytes()), Length: len(frame.Bytes())}, frame.Bytes())
+	replay := func() (*gopacket.PacketSource, error) {
+		r, err := pcapgo.NewReader(&capture)
+		if err != nil {
+			return nil, err
+		}
+		return gopacket.NewPacketSource(r, r.LinkType()), nil
+	}
+
+	for _, source := range []func() (*gopacket.PacketSource, error){injector.Source, replay} {
+		output, err := newMemTransport().Listen("output")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := listenWithTransport(&ICMPTransport{Source: source, Output: output}, "", nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.RemoteAddr().String() != "192.0.2.1#7/1" {
+			t.Fatal("unexpected remote address", s.RemoteAddr())
+		}
+		buf := make([]byte, 64)
+		s.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := s.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatal("unexpected payload", string(buf[:n]), err)
+		}
+		s.Close()
+		l.Close()
+		output.Close()
+	}
+}
+
+func TestICMPMalformedMessages(t *testing.T) {
+	var pkt []byte
+	kcp := NewKCP(1, func(buf []byte, size int) {
+		pkt = append([]byte(nil), buf[:size]...)
+	})
+	kcp.NoDelay(1, 10, 2, 1)
+	kcp.Syn()
+	kcp.Send([]byte("hello"))
+	kcp.flush(false)
+
+	requestTag, _ := new(ICMPTransport).tags()
+	good, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 7, Data: append(requestTag, pkt...)}}).Marshal(nil)
+	badCode, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Code: 1, Body: &icmp.Echo{ID: 7, Data: append(requestTag, pkt...)}}).Marshal(nil)
+	short := []byte{byte(ipv4.ICMPTypeEcho), 0, 0, 0}
+
+	injector := NewPacketInjector()
+	defer injector.Close()
+	for _, msg := range [][]byte{badCode, short, good} {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("192.0.2.2")}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, gopacket.Payload(msg)); err != nil {
+			t.Fatal(err)
+		}
+		injector.Inject(buf.Bytes())
+	}
+
+	output, err := newMemTransport().Listen("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	inErrs := atomic.LoadUint64(&DefaultSnmp.InErrs)
+	l, err := listenWithTransport(&ICMPTransport{Source: injector.Source, Output: output}, "", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the malformed messages are dropped, the listener still accepts
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 64)
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("unexpected payload", string(buf[:n]), err)
+	}
+	if n := atomic.LoadUint64(&DefaultSnmp.InErrs) - inErrs; n != 2 {
+		t.Fatal("dropped messages counted", n)
+	}
+}
+
+func TestCaptureInterfaceIndex(t *testing.T) {
+	msg, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 7, Data: []byte("hello")}}).Marshal(nil)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("192.0.2.2")}
+	raw := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(raw, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, gopacket.Payload(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	// replies go out of the interface of the capture the request came from
+	var sources []chan gopacket.Packet
+	for i := 0; i < 2; i++ {
+		injector := NewPacketInjector()
+		defer injector.Close()
+		injector.Inject(raw.Bytes())
+		source, _ := injector.Source()
+		sources = append(sources, source.Packets())
+	}
+	r := newPacketReader(icmpv4, mergePackets(sources, []int{3, 5}), nil, true)
+	seen := make(map[int]bool)
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		_, path, err := r.ReadICMP(make([]byte, 64))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm4, _ := path.addr(7).controlMessages()
+		seen[cm4.IfIndex] = true
+	}
+	if !seen[3] || !seen[5] {
+		t.Fatal("unexpected interfaces of the replies", seen)
+	}
+
+	// the interface numbers of a replayed pcapng file are its own
+	var capture bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&capture, layers.LinkTypeRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := w.AddInterface(pcapgo.NgInterface{Name: "eth1", LinkType: layers.LinkTypeRaw})
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(raw.Bytes()), Length: len(raw.Bytes()), InterfaceIndex: id}, raw.Bytes())
+	w.Flush()
+	ng, err := pcapgo.NewNgReader(&capture, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = newPacketReader(icmpv4, gopacket.NewPacketSource(ng, ng.LinkType()).Packets(), nil, false)
+	_, path, err := r.ReadICMP(make([]byte, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm4, _ := path.addr(7).controlMessages(); cm4.IfIndex != 0 {
+		t.Fatal("replay pinned the reply to interface", cm4.IfIndex)
+	}
+}
+
+// BenchmarkICMPRTT measures the round trip time of small messages over the
+// loopback interface, with the pcap capture in immediate and buffered mode,
+// it needs the privileges to open ICMP sockets and captures.
+func BenchmarkICMPRTT(b *testing.B) {
+	b.Run("Immediate", func(b *testing.B) {
+		benchmarkICMPRTT(b, CaptureOptions{})
+	})
+	b.Run("Buffered", func(b *testing.B) {
+		benchmarkICMPRTT(b, CaptureOptions{NoImmediate: true})
+	})
+}
+
+func benchmarkICMPRTT(b *testing.B, opts CaptureOptions) {
+	tr := &ICMPTransport{Dev: "lo", Capture: opts, EchoIDMode: EchoIDFixed, EchoID: 4242}
+	l, err := listenWithTransport(tr, "127.0.0.1", nil, 0, 0)
+	if err != nil {
+		b.Skip("ICMP listener unavailable:", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.SetNoDelay(1, 10, 2, 1)
+			go func() {
+				buf := make([]byte, 64)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	cli, err := dialWithTransport(tr, "127.0.0.1", nil, 0, 0, dialTimeout)
+	if err != nil {
+		b.Skip("ICMP client unavailable:", err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetDeadline(time.Now().Add(time.Minute))
+
+	b.ResetTimer()
+	if err := echo_tester(cli, 64, b.N); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestLinkDecoder(t *testing.T) {
+	msg, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 7, Data: []byte("kcp")}}).Marshal(nil)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("192.0.2.2")}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, gopacket.Payload(msg)); err != nil {
+		t.Fatal(err)
+	}
+	packet := buf.Bytes()
+
+	ethernet := []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1, 0x08, 0x00}
+	sll := []byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0, 0x08, 0x00}
+	null := []byte{2, 0, 0, 0} // AF_INET in host byte order
+	loop := []byte{0, 0, 0, 2} // AF_INET in network byte order
+	cases := []struct {
+		linkType layers.LinkType
+		header   []byte
+	}{
+		{layers.LinkTypeEthernet, ethernet},
+		{layers.LinkTypeLinuxSLL, sll},
+		{layers.LinkTypeNull, null},
+		{layers.LinkTypeLoop, loop},
+		{layers.LinkTypeRaw, nil},
+		{linkTypeRawDLT, nil},
+		{layers.LinkTypeIPv4, nil},
+	}
+	for _, c := range cases {
+		decoder, err := linkDecoder(c.linkType)
+		if err != nil {
+			t.Fatal(c.linkType, err)
+		}
+		p := gopacket.NewPacket(append(append([]byte{}, c.header...), packet...), decoder, gopacket.Default)
+		p.Metadata().InterfaceIndex = 3
+		packets := make(chan gopacket.Packet, 1)
+		packets <- p
+		close(packets)
+
+		r := newPacketReader(icmpv4, packets, nil, true)
+		b := make([]byte, 1500)
+		n, path, err := r.ReadICMP(b)
+		if err != nil {
+			t.Fatal(c.linkType, err)
+		}
+		if !bytes.Equal(b[:n], msg) || !path.src.Equal(ip.SrcIP) || !path.dst.Equal(ip.DstIP) || path.ifindex != 3 {
+			t.Fatal(c.linkType, "unexpected message", path)
+		}
+	}
+
+	if _, err := linkDecoder(layers.LinkTypeIEEE802_11); err == nil {
+		t.Fatal("unsupported link type should be refused")
+	}
+}
+
+func TestIPv4Reassembly(t *testing.T) {
+	msg, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 7, Data: make([]byte, 3000)}}).Marshal(nil)
+	fragment := func(id uint16, offset, size int, more bool) *layers.IPv4 {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Id: id, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("192.0.2.2"), FragOffset: uint16(offset / 8)}
+		if more {
+			ip.Flags = layers.IPv4MoreFragments
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, gopacket.Payload(msg[offset:offset+size])); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	}
+
+	// out of order, with a duplicate, through the packet reader
+	frags := []*layers.IPv4{fragment(1, 1480, 1480, true), fragment(1, 0, 1480, true), fragment(1, 1480, 1480, true), fragment(1, 2960, len(msg)-2960, false)}
+	packets := make(chan gopacket.Packet, len(frags))
+	for _, ip := range frags {
+		packets <- gopacket.NewPacket(append(append([]byte{}, ip.Contents...), ip.Payload...), layers.LayerTypeIPv4, gopacket.Default)
+	}
+	close(packets)
+	reassembled := atomic.LoadUint64(&DefaultSnmp.FragReassembled)
+	r := newPacketReader(icmpv4, packets, nil, false)
+	b := make([]byte, 4000)
+	n, _, err := r.ReadICMP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], msg) {
+		t.Fatal("reassembled message differs")
+	}
+	if d := atomic.LoadUint64(&DefaultSnmp.FragReassembled) - reassembled; d != 3 {
+		t.Fatal("unexpected reassembled fragments", d)
+	}
+
+	now := time.Now()
+	expired := atomic.LoadUint64(&DefaultSnmp.FragExpired)
+	d := newIPv4Reassembler()
+
+	// incomplete datagrams time out
+	d.add(fragment(2, 0, 1480, true), now)
+	d.add(fragment(3, 0, 1480, true), now.Add(defragTimeout))
+	if len(d.packets) != 1 || atomic.LoadUint64(&DefaultSnmp.FragExpired)-expired != 1 {
+		t.Fatal("timed out datagram not removed")
+	}
+
+	// overlapping fragments drop the datagram
+	if _, ok := d.add(fragment(3, 8, 1480, true), now.Add(defragTimeout)); ok || len(d.packets) != 0 {
+		t.Fatal("overlapping fragment accepted")
+	}
+
+	// the oldest datagrams make room for new ones
+	for id := 0; id < defragMaxBytes/1480+10; id++ {
+		d.add(fragment(uint16(id), 0, 1480, true), now.Add(time.Duration(id)))
+	}
+	if d.size > defragMaxBytes {
+		t.Fatal("reassembler holds", d.size, "bytes")
+	}
+}
+
+func TestICMPReplyPath(t *testing.T) {
+	// the kernel would answer 127.0.0.2 from 127.0.0.1, which the client
+	// drops, unless the listener replies from the address it was sent to
+	tr := &ICMPTransport{Devs: []string{"lo"}, EchoIDMode: EchoIDFixed, EchoID: 4243}
+	l, err := listenWithTransport(tr, "", nil, 0, 0)
+	if err != nil {
+		t.Skip("ICMP listener unavailable:", err)
+	}
+	defer l.Close()
+	chDevice := make(chan string, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		chDevice <- s.Device()
+		buf := make([]byte, 64)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			s.Write(buf[:n])
+		}
+	}()
+
+	cli, err := dialWithTransport(tr, "127.0.0.2", nil, 0, 0, dialTimeout)
+	if err != nil {
+		t.Skip("ICMP client unavailable:", err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := echo_tester(cli, 64, 10); err != nil {
+		t.Fatal(err)
+	}
+	if dev := <-chDevice; dev != "lo" {
+		t.Fatal("unexpected device of the accepted session", dev)
+	}
+}
+
+func TestICMPUnprivileged(t *testing.T) {
+	for _, tr := range []*ICMPTransport{
+		{Unprivileged: true, Carrier: CarrierTimestamp},
+		{Unprivileged: true, EchoIDMode: EchoIDFixed},
+		{Unprivileged: true, Source: func() (*gopacket.PacketSource, error) { return nil, io.EOF }},
+		{Unprivileged: true, Output: new(net.UDPConn)},
+	} {
+		if _, _, err := tr.Dial("127.0.0.1"); err == nil {
+			t.Fatal("unsupported unprivileged client options accepted")
+		}
+	}
+	if _, err := (&ICMPTransport{Unprivileged: true}).Listen("127.0.0.1"); err == nil {
+		t.Fatal("unprivileged listener accepted")
+	}
+
+	l, err := listenWithTransport(&ICMPTransport{Dev: "lo"}, "127.0.0.1", nil, 0, 0)
+	if err != nil {
+		t.Skip("ICMP listener unavailable:", err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 64)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			s.Write(buf[:n])
+		}
+	}()
+
+	cli, err := dialWithTransport(&ICMPTransport{Unprivileged: true}, "127.0.0.1", nil, 0, 0, dialTimeout)
+	if err != nil {
+		t.Skip("ping sockets unavailable:", err)
+	}
+	defer cli.Close()
+
+	// the echo identifier is the one the kernel put in the requests
+	port := cli.conn.LocalAddr().(*net.UDPAddr).Port
+	if id := cli.remote.(*ICMPAddr).ID; id != port {
+		t.Fatal("echo identifier", id, "differs from the socket's", port)
+	}
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := echo_tester(cli, 64, 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		_, ipnet, _ := net.ParseCIDR(s)
+		return ipnet
+	}
+	routes := []routeEntry{
+		{dst: cidr("0.0.0.0/0"), ifindex: 2, priority: 100},
+		{dst: cidr("0.0.0.0/0"), ifindex: 3, priority: 50},
+		{dst: cidr("192.0.2.0/24"), ifindex: 4},
+		{dst: cidr("192.0.2.2/32"), ifindex: 4, local: true},
+	}
+	cases := []struct {
+		dst     string
+		ifindex int
+		local   bool
+	}{
+		{"198.51.100.1", 3, false},
+		{"192.0.2.1", 4, false},
+		{"192.0.2.2", 4, true},
+	}
+	for _, c := range cases {
+		r := matchRoute(routes, net.ParseIP(c.dst))
+		if r == nil || r.ifindex != c.ifindex || r.local != c.local {
+			t.Fatal("unexpected route to", c.dst, r)
+		}
+	}
+	if matchRoute(routes[2:], net.ParseIP("198.51.100.1")) != nil {
+		t.Fatal("no route expected")
+	}
+
+	// packets to the host itself go over loopback
+	lo, err := loopbackInterface()
+	if err != nil {
+		t.Skip(err)
+	}
+	if ifi, err := routeInterface(net.ParseIP("127.0.0.1")); err != nil || ifi.Name != lo.Name {
+		t.Fatal("route to 127.0.0.1 should use loopback", ifi, err)
+	}
+	if devices, err := captureDevices(icmpv4, nil, "", &ICMPAddr{IP: net.ParseIP("127.0.0.1")}); err != nil || len(devices) != 1 || devices[0] != lo.Name {
+		t.Fatal("unexpected capture devices", devices, err)
+	}
+	if devices, _ := captureDevices(icmpv4, []string{"eth9", "eth10"}, "", nil); len(devices) != 2 || devices[1] != "eth10" {
+		t.Fatal("explicit devices should be used", devices)
+	}
+}
+
+func TestOutboundFilter(t *testing.T) {
+	lo, err := routeInterface(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Skip("no loopback route:", err)
+	}
+	if expr, err := outboundFilter(icmpv4, lo.Name); err != nil || !strings.Contains(expr, "src host 127.0.0.1") || strings.Contains(expr, "::1") {
+		t.Fatal("unexpected outbound filter", expr, err)
+	}
+	if expr, err := outboundFilter(icmpv4, anyDevice); err != nil || !strings.Contains(expr, "src host 127.0.0.1") {
+		t.Fatal("unexpected outbound filter of the any device", expr, err)
+	}
+	if _, err := outboundFilter(icmpv4, "nonexistent0"); err == nil {
+		t.Fatal("outbound filter of a missing device")
+	}
+}
+
+// timedConn records when messages are written to it
+type timedConn struct {
+	net.PacketConn
+	writes chan time.Time
+}
+
+func (c *timedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.writes <- time.Now()
+	return len(b), nil
+}
+
+func TestShapedPacing(t *testing.T) {
+	injector := NewPacketInjector()
+	defer injector.Close()
+	output, err := newMemTransport().Listen("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	timed := &timedConn{output, make(chan time.Time, shapeMaxQueue)}
+
+	interval := 20 * time.Millisecond
+	tr := &ICMPTransport{Source: injector.Source, Output: timed, Shape: true, ShapeInterval: interval}
+	conn, err := dialICMPConn(tr, icmpv4, "", nil, anyEchoID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// writes return without waiting for the messages to be paced
+	dst := &ICMPAddr{IP: net.ParseIP("192.0.2.1"), ID: 7}
+	packet := make([]byte, 3*shapeChunkSize)
+	start := time.Now()
+	if _, err := conn.WriteTo(packet, dst); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= interval {
+		t.Fatal("WriteTo waited for pacing", d)
+	}
+
+	var last time.Time
+	for k := 0; k < 3; k++ {
+		select {
+		case ts := <-timed.writes:
+			if k > 0 && ts.Sub(last) < interval {
+				t.Fatal("messages not paced", ts.Sub(last))
+			}
+			last = ts
+		case <-time.After(time.Second):
+			t.Fatal("message", k, "not sent")
+		}
+	}
+
+	// a packet not fitting in the queue is dropped whole
+	if _, err := conn.WriteTo(make([]byte, shapeChunkSize*shapeMaxFragments), dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(make([]byte, shapeChunkSize*shapeMaxFragments), dst); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(conn.chShaped); n > shapeMaxFragments {
+		t.Fatal("partial packet queued", n)
+	}
+
+	// shaped packets sized by the overhead fit the default MTU on the wire
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		addr := &net.IPAddr{IP: net.ParseIP(ip)}
+		frags, err := shapeFragments(0, make([]byte, IKCP_MTU_DEF-tr.Overhead(addr)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := ipHeaderSize(addr) + icmpHeaderSize + shapePayloadSize
+		if wire := len(frags) * message; wire > IKCP_MTU_DEF || wire+message <= IKCP_MTU_DEF {
+			t.Fatal(ip, "shaped packet takes", wire, "bytes on the wire")
+		}
+	}
+}
@@ -15,8 +15,18 @@ const (
 	IKCP_CMD_ACK     = 82 // cmd: ack
 	IKCP_CMD_WASK    = 83 // cmd: window probe (ask)
 	IKCP_CMD_WINS    = 84 // cmd: window size (tell)
+	IKCP_CMD_SACK    = 85 // cmd: selective ack
+	IKCP_CMD_FIN     = 87 // cmd: no more data, sequenced like data
+	IKCP_CMD_RST     = 88 // cmd: reset, the connection is unknown or aborted
 	IKCP_ASK_SEND    = 1  // need to send IKCP_CMD_WASK
 	IKCP_ASK_TELL    = 2  // need to send IKCP_CMD_WINS
+	IKCP_ASK_SACK    = 4  // need to send IKCP_CMD_SACK
+	IKCP_ASK_MTU     = 8  // need to send IKCP_CMD_WINS answering an MTU probe
+	IKCP_ASK_SYN     = 16 // need to send the SYN, or IKCP_CMD_WINS answering one
+	IKCP_ACK_SACK    = 1  // frg of IKCP_CMD_ACK: the sender understands IKCP_CMD_SACK
+	IKCP_SACK_ECHO   = 1  // frg of IKCP_CMD_SACK: sn and ts echo a received segment
+	IKCP_WASK_MTU    = 1  // frg of IKCP_CMD_WASK and IKCP_CMD_WINS: an MTU probe and its answer, sn is the probe's size
+	IKCP_WASK_SYN    = 2  // frg of IKCP_CMD_WASK and IKCP_CMD_WINS: a SYN and its answer, the sender understands IKCP_CMD_FIN and IKCP_CMD_RST
 	IKCP_WND_SND     = 32
 	IKCP_WND_RCV     = 32
 	IKCP_MTU_DEF     = 1400
@@ -123,19 +133,29 @@ func (seg *segment) encode(ptr []byte) []byte {
 
 // KCP defines a single KCP connection
 type KCP struct {
-	conv, mtu, mss, state                  uint32
-	snd_una, snd_nxt, rcv_nxt              uint32
-	ssthresh                               uint32
-	rx_rttvar, rx_srtt                     int32
-	rx_rto, rx_minrto                      uint32
-	snd_wnd, rcv_wnd, rmt_wnd, cwnd, probe uint32
-	interval, ts_flush                     uint32
-	nodelay, updated                       uint32
-	ts_probe, probe_wait                   uint32
-	dead_link, incr                        uint32
-
-	fastresend     int32
-	nocwnd, stream int32
+	conv, mtu, mss, state            uint32
+	snd_una, snd_nxt, rcv_nxt        uint32
+	rx_rttvar, rx_srtt               int32
+	rx_rto, rx_minrto                uint32
+	snd_wnd, rcv_wnd, rmt_wnd, probe uint32
+	interval, ts_flush               uint32
+	nodelay, updated                 uint32
+	ts_probe, probe_wait             uint32
+	dead_link                        uint32
+	mtu_probe                        uint32 // size of the last MTU probe received, echoed by the answer
+	mtu_ack                          uint32 // size echoed by the last answer to our MTU probes
+
+	fastresend             int32
+	nocwnd, stream, nosack int32
+	rmt_sack               uint32 // the peer understands IKCP_CMD_SACK
+
+	// connection management, see Syn and Fin
+	opening  uint32 // a SYN was sent and the peer didn't answer yet, resets are ignored
+	ts_syn   uint32 // when the SYN is sent again
+	closing  uint32 // a FIN was queued after the data
+	rmt_ctrl uint32 // the peer understands IKCP_CMD_FIN and IKCP_CMD_RST
+	rmt_fin  uint32 // the peer's FIN arrived, after all of its data
+	rmt_rst  uint32 // the peer reset the connection
 
 	snd_queue []segment
 	rcv_queue []segment
@@ -144,6 +164,14 @@ type KCP struct {
 
 	acklist []ackItem
 
+	cc    CongestionController
+	acked uint32 // segments acknowledged since cc was last told
+
+	// pacing, the budget is in thousandths of bytes so low rates add up
+	pacing, pace_rate uint32 // enabled, bytes per second, 0 to pace at the window per srtt
+	pace_ts           uint32 // last time the budget was topped up
+	pace_budget       int64  // may go below zero, the excess sent delays the next send
+
 	buffer []byte
 	output output_callback
 }
@@ -168,7 +196,7 @@ func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp.rx_minrto = IKCP_RTO_MIN
 	kcp.interval = IKCP_INTERVAL
 	kcp.ts_flush = IKCP_INTERVAL
-	kcp.ssthresh = IKCP_THRESH_INIT
+	kcp.cc = NewRenoController()
 	kcp.dead_link = IKCP_DEADLINK
 	kcp.output = output
 	return kcp
@@ -260,8 +288,10 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	}
 
 	if count > 0 {
+		first := len(kcp.rcv_queue)
 		kcp.rcv_queue = append(kcp.rcv_queue, kcp.rcv_buf[:count]...)
 		kcp.rcv_buf = kcp.remove_front(kcp.rcv_buf, count)
+		kcp.ctrl_recv(first)
 	}
 
 	// fast recover
@@ -285,7 +315,7 @@ func (kcp *KCP) Send(buffer []byte) int {
 		n := len(kcp.snd_queue)
 		if n > 0 {
 			seg := &kcp.snd_queue[n-1]
-			if len(seg.data) < int(kcp.mss) {
+			if len(seg.data) < int(kcp.mss) && seg.cmd == 0 {
 				capacity := int(kcp.mss) - len(seg.data)
 				extend := capacity
 				if len(buffer) < capacity {
@@ -374,23 +404,36 @@ func (kcp *KCP) shrink_buf() {
 	}
 }
 
-func (kcp *KCP) parse_ack(sn uint32) {
-	if _itimediff(sn, kcp.snd_una) < 0 || _itimediff(sn, kcp.snd_nxt) >= 0 {
+// parse_ack removes the segments acknowledged, from first up to end
+// (excluded), from snd_buf
+func (kcp *KCP) parse_ack(first, end uint32) {
+	if _itimediff(first, kcp.snd_una) < 0 {
+		first = kcp.snd_una
+	}
+	if _itimediff(end, kcp.snd_nxt) > 0 {
+		end = kcp.snd_nxt
+	}
+	if _itimediff(end, first) <= 0 {
 		return
 	}
 
-	for k := range kcp.snd_buf {
-		seg := &kcp.snd_buf[k]
-		if sn == seg.sn {
-			kcp.delSegment(*seg)
-			copy(kcp.snd_buf[k:], kcp.snd_buf[k+1:])
-			kcp.snd_buf[len(kcp.snd_buf)-1] = segment{}
-			kcp.snd_buf = kcp.snd_buf[:len(kcp.snd_buf)-1]
-			break
-		}
-		if _itimediff(sn, seg.sn) < 0 {
-			break
+	i := 0
+	for i < len(kcp.snd_buf) && _itimediff(kcp.snd_buf[i].sn, first) < 0 {
+		i++
+	}
+	j := i
+	for j < len(kcp.snd_buf) && _itimediff(kcp.snd_buf[j].sn, end) < 0 {
+		kcp.delSegment(kcp.snd_buf[j])
+		j++
+	}
+	if j > i {
+		n := copy(kcp.snd_buf[i:], kcp.snd_buf[j:])
+		gc := kcp.snd_buf[i+n:]
+		for k := range gc {
+			gc[k] = segment{}
 		}
+		kcp.snd_buf = kcp.snd_buf[:i+n]
+		kcp.acked += uint32(j - i)
 	}
 }
 
@@ -422,6 +465,7 @@ func (kcp *KCP) parse_una(una uint32) {
 	}
 	if count > 0 {
 		kcp.snd_buf = kcp.remove_front(kcp.snd_buf, count)
+		kcp.acked += uint32(count)
 	}
 }
 
@@ -430,6 +474,17 @@ func (kcp *KCP) ack_push(sn, ts uint32) {
 	kcp.acklist = append(kcp.acklist, ackItem{sn, ts})
 }
 
+// sack_peer records the peer understands IKCP_CMD_SACK, and tells it we do
+// too, in case it never sends us data to acknowledge
+func (kcp *KCP) sack_peer() {
+	if kcp.rmt_sack == 0 {
+		kcp.rmt_sack = 1
+		if kcp.nosack == 0 {
+			kcp.probe |= IKCP_ASK_SACK
+		}
+	}
+}
+
 func (kcp *KCP) parse_data(newseg segment) {
 	sn := newseg.sn
 	if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) >= 0 ||
@@ -478,11 +533,32 @@ func (kcp *KCP) parse_data(newseg segment) {
 		}
 	}
 	if count > 0 {
+		first := len(kcp.rcv_queue)
 		kcp.rcv_queue = append(kcp.rcv_queue, kcp.rcv_buf[:count]...)
 		kcp.rcv_buf = kcp.remove_front(kcp.rcv_buf, count)
+		kcp.ctrl_recv(first)
 	}
 }
 
+// ctrl_recv takes the FIN segments out of the ones just moved to rcv_queue,
+// from index first on, they only take a sequence number
+func (kcp *KCP) ctrl_recv(first int) {
+	q := kcp.rcv_queue[:first]
+	for _, seg := range kcp.rcv_queue[first:] {
+		if seg.cmd == IKCP_CMD_FIN {
+			kcp.rmt_fin = 1
+			kcp.delSegment(seg)
+		} else {
+			q = append(q, seg)
+		}
+	}
+	gc := kcp.rcv_queue[len(q):]
+	for k := range gc {
+		gc[k] = segment{}
+	}
+	kcp.rcv_queue = q
+}
+
 // Input when you received a low level packet (eg. UDP packet), call it
 // regular indicates a regular packet has received(not from FEC)
 func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
@@ -522,10 +598,24 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		}
 
 		if cmd != IKCP_CMD_PUSH && cmd != IKCP_CMD_ACK &&
-			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS {
+			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS &&
+			cmd != IKCP_CMD_SACK && cmd != IKCP_CMD_FIN &&
+			cmd != IKCP_CMD_RST {
 			return -3
 		}
 
+		// a reset tells nothing else, and may come from a listener
+		// which doesn't know the connection
+		if cmd == IKCP_CMD_RST {
+			if kcp.opening == 0 {
+				kcp.rmt_rst = 1
+			}
+			inSegs++
+			data = data[length:]
+			continue
+		}
+		kcp.opening = 0
+
 		// only trust window updates from regular packets. i.e: latest update
 		if regular {
 			kcp.rmt_wnd = uint32(wnd)
@@ -534,7 +624,10 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		kcp.shrink_buf()
 
 		if cmd == IKCP_CMD_ACK {
-			kcp.parse_ack(sn)
+			if frg&IKCP_ACK_SACK != 0 {
+				kcp.sack_peer()
+			}
+			kcp.parse_ack(sn, sn+1)
 			kcp.shrink_buf()
 			if flag == 0 {
 				flag = 1
@@ -544,7 +637,38 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 				maxack = sn
 				lastackts = ts
 			}
-		} else if cmd == IKCP_CMD_PUSH {
+		} else if cmd == IKCP_CMD_SACK {
+			kcp.sack_peer()
+			if frg&IKCP_SACK_ECHO != 0 {
+				if flag == 0 {
+					flag = 1
+					maxack = sn
+					lastackts = ts
+				} else if _itimediff(sn, maxack) > 0 {
+					maxack = sn
+					lastackts = ts
+				}
+
+				// ranges of offset from una and count, segments
+				// below the highest received count towards fast
+				// retransmits
+				ranges := data[:length]
+				for len(ranges) >= 4 {
+					var offset, count uint16
+					ranges = ikcp_decode16u(ranges, &offset)
+					ranges = ikcp_decode16u(ranges, &count)
+					if count == 0 {
+						continue
+					}
+					first := una + uint32(offset)
+					kcp.parse_ack(first, first+uint32(count))
+					if last := first + uint32(count) - 1; _itimediff(last, maxack) > 0 {
+						maxack = last
+					}
+				}
+				kcp.shrink_buf()
+			}
+		} else if cmd == IKCP_CMD_PUSH || cmd == IKCP_CMD_FIN {
 			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) < 0 {
 				kcp.ack_push(sn, ts)
 				if _itimediff(sn, kcp.rcv_nxt) >= 0 {
@@ -567,9 +691,21 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		} else if cmd == IKCP_CMD_WASK {
 			// ready to send back IKCP_CMD_WINS in Ikcp_flush
 			// tell remote my window size
-			kcp.probe |= IKCP_ASK_TELL
+			if frg&IKCP_WASK_MTU != 0 {
+				kcp.mtu_probe = sn
+				kcp.probe |= IKCP_ASK_MTU
+			} else if frg&IKCP_WASK_SYN != 0 {
+				kcp.rmt_ctrl = 1
+				kcp.probe |= IKCP_ASK_SYN
+			} else {
+				kcp.probe |= IKCP_ASK_TELL
+			}
 		} else if cmd == IKCP_CMD_WINS {
-			// do nothing
+			if frg&IKCP_WASK_MTU != 0 {
+				kcp.mtu_ack = sn
+			} else if frg&IKCP_WASK_SYN != 0 {
+				kcp.rmt_ctrl = 1
+			}
 		} else {
 			return -3
 		}
@@ -579,34 +715,19 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 	}
 	atomic.AddUint64(&DefaultSnmp.InSegs, inSegs)
 
+	rtt := int32(-1)
+	current := currentMs()
 	if flag != 0 && regular {
 		kcp.parse_fastack(maxack)
-		current := currentMs()
 		if _itimediff(current, lastackts) >= 0 {
-			kcp.update_ack(_itimediff(current, lastackts))
+			rtt = _itimediff(current, lastackts)
+			kcp.update_ack(rtt)
 		}
 	}
 
 	if _itimediff(kcp.snd_una, snd_una) > 0 {
-		if kcp.cwnd < kcp.rmt_wnd {
-			mss := kcp.mss
-			if kcp.cwnd < kcp.ssthresh {
-				kcp.cwnd++
-				kcp.incr += mss
-			} else {
-				if kcp.incr < mss {
-					kcp.incr = mss
-				}
-				kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
-				if (kcp.cwnd+1)*mss <= kcp.incr {
-					kcp.cwnd++
-				}
-			}
-			if kcp.cwnd > kcp.rmt_wnd {
-				kcp.cwnd = kcp.rmt_wnd
-				kcp.incr = kcp.rmt_wnd * mss
-			}
-		}
+		kcp.cc.OnAck(kcp.congestionState(current), kcp.acked, rtt)
+		kcp.acked = 0
 	}
 
 	if ackNoDelay && len(kcp.acklist) > 0 { // ack immediately
@@ -633,19 +754,30 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	buffer := kcp.buffer
 	// flush acknowledges
 	ptr := buffer
-	for i, ack := range kcp.acklist {
-		size := len(buffer) - len(ptr)
-		if size+IKCP_OVERHEAD > int(kcp.mtu) {
-			kcp.output(buffer, size)
-			ptr = buffer
+	if kcp.nosack == 0 && kcp.rmt_sack != 0 {
+		if len(kcp.acklist) > 0 || (kcp.probe&IKCP_ASK_SACK) != 0 {
+			ptr = kcp.sack(ptr, seg)
+		}
+	} else {
+		if kcp.nosack == 0 {
+			seg.frg = IKCP_ACK_SACK
 		}
-		// filter jitters caused by bufferbloat
-		if ack.sn >= kcp.rcv_nxt || len(kcp.acklist)-1 == i {
-			seg.sn, seg.ts = ack.sn, ack.ts
-			ptr = seg.encode(ptr)
+		for i, ack := range kcp.acklist {
+			size := len(buffer) - len(ptr)
+			if size+IKCP_OVERHEAD > int(kcp.mtu) {
+				kcp.output(buffer, size)
+				ptr = buffer
+			}
+			// filter jitters caused by bufferbloat
+			if ack.sn >= kcp.rcv_nxt || len(kcp.acklist)-1 == i {
+				seg.sn, seg.ts = ack.sn, ack.ts
+				ptr = seg.encode(ptr)
+			}
 		}
+		seg.frg = 0
 	}
 	kcp.acklist = kcp.acklist[0:0]
+	kcp.probe &^= IKCP_ASK_SACK
 
 	if ackOnly { // flash remain ack segments
 		size := len(buffer) - len(ptr)
@@ -701,12 +833,47 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		ptr = seg.encode(ptr)
 	}
 
+	// answer MTU probes, echoing the size that got through
+	if (kcp.probe & IKCP_ASK_MTU) != 0 {
+		seg.cmd = IKCP_CMD_WINS
+		seg.frg = IKCP_WASK_MTU
+		seg.sn = kcp.mtu_probe
+		size := len(buffer) - len(ptr)
+		if size+IKCP_OVERHEAD > int(kcp.mtu) {
+			kcp.output(buffer, size)
+			ptr = buffer
+		}
+		ptr = seg.encode(ptr)
+		seg.frg, seg.sn = 0, 0
+	}
+
+	// the SYN is a window probe flagged with IKCP_WASK_SYN, which peers
+	// without the handshake answer too, it's sent until the peer answers
+	if kcp.opening != 0 && _itimediff(currentMs(), kcp.ts_syn) >= 0 {
+		kcp.probe |= IKCP_ASK_SYN
+		kcp.ts_syn = currentMs() + uint32(kcp.rx_rto)
+	}
+	if (kcp.probe & IKCP_ASK_SYN) != 0 {
+		seg.cmd = IKCP_CMD_WINS
+		if kcp.opening != 0 {
+			seg.cmd = IKCP_CMD_WASK
+		}
+		seg.frg = IKCP_WASK_SYN
+		size := len(buffer) - len(ptr)
+		if size+IKCP_OVERHEAD > int(kcp.mtu) {
+			kcp.output(buffer, size)
+			ptr = buffer
+		}
+		ptr = seg.encode(ptr)
+		seg.frg = 0
+	}
+
 	kcp.probe = 0
 
 	// calculate window size
 	cwnd := _imin_(kcp.snd_wnd, kcp.rmt_wnd)
 	if kcp.nocwnd == 0 {
-		cwnd = _imin_(kcp.cwnd, cwnd)
+		cwnd = _imin_(kcp.cc.Window(), cwnd)
 	}
 
 	// sliding window, controlled by snd_nxt && sna_una+cwnd
@@ -717,7 +884,9 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		}
 		newseg := kcp.snd_queue[k]
 		newseg.conv = kcp.conv
-		newseg.cmd = IKCP_CMD_PUSH
+		if newseg.cmd == 0 {
+			newseg.cmd = IKCP_CMD_PUSH
+		}
 		newseg.sn = kcp.snd_nxt
 		kcp.snd_buf = append(kcp.snd_buf, newseg)
 		kcp.snd_nxt++
@@ -738,10 +907,18 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	current := currentMs()
 	var change, lost, lostSegs, fastRetransSegs, earlyRetransSegs uint64
 	minrto := int32(kcp.interval)
+	rate := kcp.pace(current, cwnd)
 
 	ref := kcp.snd_buf[:len(kcp.snd_buf)] // for bounds check elimination
 	for k := range ref {
 		segment := &ref[k]
+		if rate > 0 && kcp.pace_budget <= 0 {
+			// the rest waits for the budget to be topped up
+			if wait := int32(-kcp.pace_budget/int64(rate)) + 1; wait < minrto {
+				minrto = wait
+			}
+			break
+		}
 		needsend := false
 		if segment.xmit == 0 { // initial transmit
 			needsend = true
@@ -791,6 +968,9 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			ptr = segment.encode(ptr)
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
+			if rate > 0 {
+				kcp.pace_budget -= int64(need) * 1000
+			}
 
 			if segment.xmit >= kcp.dead_link {
 				kcp.state = 0xFFFFFFFF
@@ -826,34 +1006,51 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		atomic.AddUint64(&DefaultSnmp.RetransSegs, sum)
 	}
 
-	// update ssthresh
-	// rate halving, https://tools.ietf.org/html/rfc6937
-	if change > 0 {
-		inflight := kcp.snd_nxt - kcp.snd_una
-		kcp.ssthresh = inflight / 2
-		if kcp.ssthresh < IKCP_THRESH_MIN {
-			kcp.ssthresh = IKCP_THRESH_MIN
-		}
-		kcp.cwnd = kcp.ssthresh + resent
-		kcp.incr = kcp.cwnd * kcp.mss
+	if change > 0 || lost > 0 {
+		kcp.cc.OnLoss(kcp.congestionState(current), uint32(change), uint32(lost))
 	}
 
-	// congestion control, https://tools.ietf.org/html/rfc5681
-	if lost > 0 {
-		kcp.ssthresh = cwnd / 2
-		if kcp.ssthresh < IKCP_THRESH_MIN {
-			kcp.ssthresh = IKCP_THRESH_MIN
-		}
-		kcp.cwnd = 1
-		kcp.incr = kcp.mss
-	}
+	return uint32(minrto)
+}
 
-	if kcp.cwnd < 1 {
-		kcp.cwnd = 1
-		kcp.incr = kcp.mss
+// sack encodes a selective acknowledgement of the segments received out of
+// order, into ptr at the start of the buffer, echoing the newest segment of
+// acklist for RTT samples
+func (kcp *KCP) sack(ptr []byte, seg segment) []byte {
+	seg.cmd = IKCP_CMD_SACK
+	body := ptr[IKCP_OVERHEAD:]
+	n := 0
+	if len(kcp.acklist) > 0 {
+		newest := kcp.acklist[0]
+		for _, ack := range kcp.acklist[1:] {
+			if _itimediff(ack.sn, newest.sn) > 0 {
+				newest = ack
+			}
+		}
+		seg.frg = IKCP_SACK_ECHO
+		seg.sn, seg.ts = newest.sn, newest.ts
+
+		// as many ranges as fit in a packet, the rest are acknowledged
+		// by the next ones
+		maxRanges := (int(kcp.mtu) - IKCP_OVERHEAD) / 4
+		for k := 0; k < len(kcp.rcv_buf) && n < maxRanges; {
+			first := kcp.rcv_buf[k].sn
+			end := first + 1
+			for k++; k < len(kcp.rcv_buf) && kcp.rcv_buf[k].sn == end && end-first < 0xffff; k++ {
+				end++
+			}
+			offset := first - seg.una
+			if offset > 0xffff {
+				break
+			}
+			ikcp_encode16u(body[n*4:], uint16(offset))
+			ikcp_encode16u(body[n*4+2:], uint16(end-first))
+			n++
+		}
 	}
-
-	return uint32(minrto)
+	seg.data = body[:n*4]
+	ptr = seg.encode(ptr)
+	return ptr[len(seg.data):]
 }
 
 // Update updates state (call it repeatedly, every 10ms-100ms), or you can ask
@@ -934,6 +1131,94 @@ func (kcp *KCP) Check() uint32 {
 	return current + minimal
 }
 
+// probeMtu sends a window probe padded to size bytes and tagged as an MTU
+// probe, peers answer it with an IKCP_CMD_WINS echoing the size, which tells
+// the probe got through
+func (kcp *KCP) probeMtu(size int) {
+	if size < IKCP_OVERHEAD {
+		return
+	}
+	buf := make([]byte, size)
+	seg := segment{conv: kcp.conv, cmd: IKCP_CMD_WASK, frg: IKCP_WASK_MTU, sn: uint32(size), wnd: kcp.wnd_unused(), una: kcp.rcv_nxt}
+	seg.data = buf[IKCP_OVERHEAD:] // zero padding
+	seg.encode(buf)
+	kcp.output(buf, size)
+}
+
+// pace tops up the pacing budget, and returns the pacing rate in bytes per
+// second, 0 if transmissions aren't paced
+func (kcp *KCP) pace(current, cwnd uint32) uint32 {
+	if kcp.pacing == 0 {
+		return 0
+	}
+	rate := kcp.pace_rate
+	if rate == 0 {
+		// no RTT sample yet to spread the window over
+		if kcp.rx_srtt <= 0 {
+			return 0
+		}
+		rate = uint32(uint64(cwnd) * uint64(kcp.mtu) * 1000 * 5 / 4 / uint64(kcp.rx_srtt))
+		if rate == 0 {
+			rate = 1
+		}
+	}
+
+	// a couple of packets, or 2ms worth of them at high rates, may be sent
+	// back to back
+	burst := int64(2 * kcp.mtu * 1000)
+	if b := int64(rate) * 2; b > burst {
+		burst = b
+	}
+	if elapsed := _itimediff(current, kcp.pace_ts); elapsed > 0 {
+		kcp.pace_budget += int64(elapsed) * int64(rate)
+	}
+	kcp.pace_ts = current
+	if kcp.pace_budget > burst {
+		kcp.pace_budget = burst
+	}
+	return rate
+}
+
+// SetPacing spreads transmissions out instead of sending all the window
+// allows at once, at rate bytes per second, or 0 to pace at the window per
+// smoothed RTT
+func (kcp *KCP) SetPacing(enable bool, rate int) {
+	kcp.pacing = 0
+	if enable {
+		kcp.pacing = 1
+	}
+	kcp.pace_rate = 0
+	if rate > 0 {
+		kcp.pace_rate = uint32(rate)
+	}
+}
+
+// congestionState describes the connection to its CongestionController
+func (kcp *KCP) congestionState(current uint32) CongestionState {
+	resent := uint32(kcp.fastresend)
+	if kcp.fastresend <= 0 {
+		resent = 0xffffffff
+	}
+	return CongestionState{
+		Now:          current,
+		MSS:          kcp.mss,
+		Inflight:     kcp.snd_nxt - kcp.snd_una,
+		SendWindow:   _imin_(kcp.snd_wnd, kcp.rmt_wnd),
+		RemoteWindow: kcp.rmt_wnd,
+		FastResend:   resent,
+		SRTT:         kcp.rx_srtt,
+	}
+}
+
+// SetCongestionController replaces the congestion control of the
+// connection, nil restores the default
+func (kcp *KCP) SetCongestionController(cc CongestionController) {
+	if cc == nil {
+		cc = NewRenoController()
+	}
+	kcp.cc = cc
+}
+
 // SetMtu changes MTU size, default is 1400
 func (kcp *KCP) SetMtu(mtu int) int {
 	if mtu < 50 || mtu < IKCP_OVERHEAD {
@@ -992,6 +1277,48 @@ func (kcp *KCP) WndSize(sndwnd, rcvwnd int) int {
 	return 0
 }
 
+// Syn opens the connection, a SYN is sent with the next flushes until the
+// peer answers, which confirms it's there, and tells whether it understands
+// FIN and RST
+func (kcp *KCP) Syn() {
+	kcp.opening = 1
+	kcp.ts_syn = currentMs()
+}
+
+// Fin queues a FIN after the data sent so far, telling the peer that no more
+// data follows, peers not answering the SYN with their own don't get one
+func (kcp *KCP) Fin() {
+	if kcp.closing != 0 || kcp.rmt_ctrl == 0 {
+		return
+	}
+	seg := kcp.newSegment(0)
+	seg.cmd = IKCP_CMD_FIN
+	kcp.snd_queue = append(kcp.snd_queue, seg)
+	kcp.closing = 1
+}
+
+// finished reports whether the FIN was acknowledged, with all the data before
+// it
+func (kcp *KCP) finished() bool {
+	return kcp.closing != 0 && kcp.WaitSnd() == 0
+}
+
+// hasCmd reports whether a packet of KCP segments carries one with cmd and
+// the flags of frg set
+func hasCmd(data []byte, cmd, frg uint8) bool {
+	for len(data) >= IKCP_OVERHEAD {
+		if data[4] == cmd && data[5]&frg == frg {
+			return true
+		}
+		length := binary.LittleEndian.Uint32(data[20:])
+		if uint32(len(data)-IKCP_OVERHEAD) < length {
+			break
+		}
+		data = data[IKCP_OVERHEAD+length:]
+	}
+	return false
+}
+
 // WaitSnd gets how many packet is waiting to be sent
 func (kcp *KCP) WaitSnd() int {
 	return len(kcp.snd_buf) + len(kcp.snd_queue)
@@ -301,3 +301,285 @@ func BenchmarkFlush(b *testing.B) {
 		mu.Unlock()
 	}
 }
+
+// countCmds counts the commands of the segments in a packet
+func countCmds(counts map[uint8]int, buf []byte) {
+	for len(buf) >= IKCP_OVERHEAD {
+		counts[buf[4]]++
+		buf = buf[IKCP_OVERHEAD+int(binary.LittleEndian.Uint32(buf[20:])):]
+	}
+}
+
+func TestSACK(t *testing.T) {
+	var packets [][]byte
+	kcp1 := NewKCP(1, func(buf []byte, size int) {})
+	kcp2 := NewKCP(1, func(buf []byte, size int) {
+		packets = append(packets, append([]byte(nil), buf[:size]...))
+	})
+	kcp2.rmt_sack = 1
+
+	// segments 1 and 4 are lost
+	var pushes [][]byte
+	kcp1.output = func(buf []byte, size int) {
+		for buf := buf[:size]; len(buf) >= IKCP_OVERHEAD; {
+			n := IKCP_OVERHEAD + int(binary.LittleEndian.Uint32(buf[20:]))
+			pushes = append(pushes, append([]byte(nil), buf[:n]...))
+			buf = buf[n:]
+		}
+	}
+	for i := 0; i < 6; i++ {
+		kcp1.Send([]byte{byte(i)})
+	}
+	kcp1.WndSize(32, 32)
+	kcp1.nocwnd = 1
+	kcp1.flush(false)
+	if len(pushes) != 6 {
+		t.Fatal("segments sent", len(pushes))
+	}
+	for _, i := range []int{0, 2, 3, 5} {
+		kcp2.Input(pushes[i], true, false)
+	}
+	kcp2.flush(true)
+
+	if len(packets) != 1 {
+		t.Fatal("packets sent", len(packets))
+	}
+	counts := make(map[uint8]int)
+	countCmds(counts, packets[0])
+	if counts[IKCP_CMD_SACK] != 1 || len(counts) != 1 {
+		t.Fatal("commands sent", counts)
+	}
+	if n := len(packets[0]); n != IKCP_OVERHEAD+2*4 {
+		t.Fatal("sack size", n)
+	}
+
+	kcp1.Input(packets[0], true, false)
+	var left []uint32
+	for _, seg := range kcp1.snd_buf {
+		left = append(left, seg.sn)
+	}
+	if fmt.Sprint(left) != "[1 4]" || kcp1.snd_una != 1 {
+		t.Fatal("segments left", left, kcp1.snd_una)
+	}
+	if kcp1.snd_buf[0].fastack != 1 || kcp1.snd_buf[1].fastack != 1 {
+		t.Fatal("fast acks", kcp1.snd_buf[0].fastack, kcp1.snd_buf[1].fastack)
+	}
+}
+
+func TestSACKNegotiation(t *testing.T) {
+	for _, c := range []struct {
+		nosack1, nosack2 int32
+	}{{0, 0}, {0, 1}, {1, 0}} {
+		vnet := &LatencySimulator{}
+		vnet.Init(10, 20, 40, 1000)
+		sent1 := make(map[uint8]int)
+		sent2 := make(map[uint8]int)
+		negotiated := make(map[uint8]int) // sent by kcp2 knowing kcp1 understands sacks
+		kcp1 := NewKCP(1, func(buf []byte, size int) {
+			countCmds(sent1, buf[:size])
+			vnet.send(0, buf, size)
+		})
+		var kcp2 *KCP
+		kcp2 = NewKCP(1, func(buf []byte, size int) {
+			countCmds(sent2, buf[:size])
+			if kcp2.rmt_sack != 0 {
+				countCmds(negotiated, buf[:size])
+			}
+			vnet.send(1, buf, size)
+		})
+		kcp1.nosack, kcp2.nosack = c.nosack1, c.nosack2
+		kcp1.NoDelay(1, 10, 2, 1)
+		kcp2.NoDelay(1, 10, 2, 1)
+
+		const count = 256
+		msg := make([]byte, 64)
+		for i := 0; i < count; i++ {
+			binary.LittleEndian.PutUint32(msg, uint32(i))
+			kcp1.Send(msg)
+		}
+		buffer := make([]byte, 2000)
+		next := 0
+		deadline := time.Now().Add(20 * time.Second)
+		for next < count && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			kcp1.Update()
+			kcp2.Update()
+			for hr := vnet.recv(1, buffer, 2000); hr >= 0; hr = vnet.recv(1, buffer, 2000) {
+				kcp2.Input(buffer[:hr], true, false)
+			}
+			for hr := vnet.recv(0, buffer, 2000); hr >= 0; hr = vnet.recv(0, buffer, 2000) {
+				kcp1.Input(buffer[:hr], true, false)
+			}
+			for hr := kcp2.Recv(buffer); hr >= 0; hr = kcp2.Recv(buffer) {
+				if binary.LittleEndian.Uint32(buffer) != uint32(next) {
+					t.Fatal("out of order", next)
+				}
+				next++
+			}
+		}
+		if next != count {
+			t.Fatal("delivered", next, "of", count)
+		}
+
+		if c.nosack1 == 0 && c.nosack2 == 0 {
+			if sent2[IKCP_CMD_SACK] == 0 || sent1[IKCP_CMD_SACK] == 0 {
+				t.Fatal("sack not negotiated", sent1, sent2)
+			}
+			if negotiated[IKCP_CMD_ACK] != 0 {
+				t.Fatal("acks sent after negotiation", negotiated)
+			}
+		} else if sent1[IKCP_CMD_SACK] != 0 || sent2[IKCP_CMD_SACK] != 0 {
+			t.Fatal("sack sent to a peer without it", sent1, sent2)
+		}
+	}
+}
+
+func TestPacing(t *testing.T) {
+	var sent int
+	kcp := NewKCP(1, func(buf []byte, size int) { sent += size })
+	kcp.WndSize(128, 128)
+	kcp.rmt_wnd = 128
+	kcp.NoDelay(0, 100, 0, 1)
+	const rate = 200000 // bytes per second
+	kcp.SetPacing(true, rate)
+	for i := 0; i < 64; i++ {
+		kcp.Send(make([]byte, 1000))
+	}
+
+	interval := kcp.flush(false)
+	if sent > 3*int(kcp.mtu) {
+		t.Fatal("burst not paced", sent)
+	}
+	if interval >= kcp.interval {
+		t.Fatal("no earlier wakeup", interval)
+	}
+
+	start := time.Now()
+	for time.Since(start) < 100*time.Millisecond {
+		time.Sleep(time.Duration(interval) * time.Millisecond)
+		interval = kcp.flush(false)
+	}
+	elapsed := time.Since(start).Seconds()
+	if expected := int(rate * elapsed); sent < expected/2 || sent > expected*2+3*int(kcp.mtu) {
+		t.Fatal("paced at", sent, "bytes, expected about", expected)
+	}
+
+	kcp.SetPacing(false, 0)
+	kcp.flush(false)
+	if sent < 64*1000 {
+		t.Fatal("unpaced flush held back segments", sent)
+	}
+}
+
+func TestSynFin(t *testing.T) {
+	var packets [][]byte
+	kcp1 := NewKCP(1, func(buf []byte, size int) {
+		packets = append(packets, append([]byte(nil), buf[:size]...))
+	})
+	var acks [][]byte
+	kcp2 := NewKCP(1, func(buf []byte, size int) {
+		acks = append(acks, append([]byte(nil), buf[:size]...))
+	})
+	kcp1.mtu = IKCP_OVERHEAD + 8 // a segment per packet
+	kcp1.nocwnd = 1
+
+	// the SYN is answered, and tells both ends they understand FIN
+	kcp1.Syn()
+	kcp1.flush(false)
+	if len(packets) != 1 || !hasCmd(packets[0], IKCP_CMD_WASK, IKCP_WASK_SYN) {
+		t.Fatal("SYN not sent", len(packets))
+	}
+	kcp2.Input(packets[0], true, false)
+	kcp2.flush(false)
+	if len(acks) != 1 || !hasCmd(acks[0], IKCP_CMD_WINS, IKCP_WASK_SYN) || kcp2.rmt_ctrl == 0 {
+		t.Fatal("SYN not answered", len(acks))
+	}
+	kcp1.Input(acks[0], true, false)
+	if kcp1.opening != 0 || kcp1.rmt_ctrl == 0 {
+		t.Fatal("SYN answer not taken")
+	}
+	packets, acks = nil, nil
+
+	kcp1.Send([]byte("hello"))
+	kcp1.Fin()
+	kcp1.flush(false)
+	if len(packets) != 2 || !hasCmd(packets[1], IKCP_CMD_FIN, 0) {
+		t.Fatal("packets sent", len(packets))
+	}
+
+	// the FIN only counts once the data before it arrived
+	kcp2.Input(packets[1], true, false)
+	if kcp2.rmt_fin != 0 {
+		t.Fatal("FIN taken before the data")
+	}
+	kcp2.Input(packets[0], true, false)
+	if kcp2.rmt_fin == 0 {
+		t.Fatal("FIN not taken")
+	}
+	buf := make([]byte, 64)
+	if n := kcp2.Recv(buf); string(buf[:n]) != "hello" {
+		t.Fatal("received", string(buf[:n]))
+	}
+	if kcp2.Recv(buf) >= 0 {
+		t.Fatal("control segments reached the receive queue")
+	}
+
+	// acknowledging them all finishes the close
+	kcp2.flush(false)
+	for _, ack := range acks {
+		kcp1.Input(ack, true, false)
+	}
+	if !kcp1.finished() {
+		t.Fatal("FIN not acknowledged", kcp1.WaitSnd())
+	}
+
+	// peers without the handshake answer the SYN like a window probe, and
+	// get no FIN
+	kcp3 := NewKCP(2, func(buf []byte, size int) {})
+	kcp3.Syn()
+	wins := make([]byte, IKCP_OVERHEAD)
+	(&segment{conv: 2, cmd: IKCP_CMD_WINS, wnd: IKCP_WND_RCV}).encode(wins)
+	kcp3.Input(wins, true, false)
+	if kcp3.opening != 0 || kcp3.rmt_ctrl != 0 {
+		t.Fatal("plain window answer", kcp3.opening, kcp3.rmt_ctrl)
+	}
+	kcp3.Fin()
+	if kcp3.closing != 0 {
+		t.Fatal("FIN queued for a peer without the handshake")
+	}
+}
+
+func TestMtuProbe(t *testing.T) {
+	var packets [][]byte
+	output := func(buf []byte, size int) {
+		packets = append(packets, append([]byte(nil), buf[:size]...))
+	}
+	kcp1 := NewKCP(1, output)
+	kcp2 := NewKCP(1, output)
+	exchange := func(from, to *KCP) {
+		packets = nil
+		from.flush(false)
+		for _, p := range packets {
+			to.Input(p, true, false)
+		}
+	}
+
+	// a window probe's answer isn't taken for an MTU probe's
+	kcp1.probe |= IKCP_ASK_SEND
+	exchange(kcp1, kcp2)
+	exchange(kcp2, kcp1)
+	if kcp1.mtu_ack != 0 {
+		t.Fatal("window probe answered as an MTU probe", kcp1.mtu_ack)
+	}
+
+	packets = nil
+	kcp1.probeMtu(300)
+	if len(packets) != 1 || len(packets[0]) != 300 {
+		t.Fatal("unexpected probe", len(packets))
+	}
+	kcp2.Input(packets[0], true, false)
+	exchange(kcp2, kcp1)
+	if kcp1.mtu_ack != 300 {
+		t.Fatal("MTU probe answer didn't echo the size", kcp1.mtu_ack)
+	}
+}
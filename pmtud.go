@@ -0,0 +1,115 @@
+package kcp
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// range of path MTUs searched, including the IP and transport headers,
+	// every IPv4 host reassembles datagrams of the minimum
+	pmtudMin = 576
+	pmtudMax = mtuLimit
+
+	// the search stops once the range left is narrower than this
+	pmtudPrecision = 8
+
+	// lost probes of a size before it's deemed too large
+	pmtudMaxProbes = 3
+
+	// bounds of the time a probe waits for its answer, the peer only
+	// answers when it flushes, up to its update interval later
+	pmtudProbeTimeoutMin = 250 * time.Millisecond
+	pmtudProbeTimeoutMax = 3 * time.Second
+
+	// time between searches, which may find the path MTU grew or shrank
+	pmtudSearchInterval = 10 * time.Minute
+)
+
+// pathMTU is the state of the packetization layer path MTU discovery of a
+// session (RFC 8899). Window probes padded to the size being tried are sent
+// one at a time with DF set, and a binary search narrows the range between
+// the largest size answered and the smallest size lost too often.
+type pathMTU struct {
+	searching bool
+	lo, hi    int  // largest size known to get through, largest size not ruled out
+	confirmed bool // a probe got through in this search, lo is only assumed otherwise
+	size      int  // size being tried, 0 to pick the next one
+	probes    int  // probes of size lost so far
+
+	inflight bool      // a probe is waiting for its answer
+	deadline time.Time // when the probe is deemed lost
+
+	next time.Time // start of the next search
+	pmtu int       // path MTU found by the last search, 0 until one completes
+}
+
+// probePathMTU advances the path MTU search of the session, sending the next
+// probe when the previous one was answered or lost, it's called with s.mu held
+func (s *UDPSession) probePathMTU(now time.Time) {
+	p := s.pmtud
+	if !p.searching {
+		if now.Before(p.next) {
+			return
+		}
+		*p = pathMTU{searching: true, lo: pmtudMin, hi: pmtudMax, pmtu: p.pmtu}
+	}
+
+	if p.inflight {
+		switch {
+		case s.kcp.mtu_ack == uint32(p.size-s.headerSize-s.overhead):
+			p.lo, p.confirmed = p.size, true
+			p.size, p.probes = 0, 0
+		case now.Before(p.deadline):
+			return
+		default:
+			if p.probes++; p.probes >= pmtudMaxProbes {
+				p.hi = p.size - 1
+				p.size, p.probes = 0, 0
+			}
+		}
+		p.inflight = false
+	}
+
+	if p.hi-p.lo < pmtudPrecision {
+		// nothing answered, the peer may not be there yet, keep the
+		// current MTU until the next search
+		if p.confirmed {
+			p.pmtu = p.lo
+			s.kcp.SetMtu(p.lo - s.headerSize - s.overhead)
+		}
+		p.searching = false
+		p.next = now.Add(pmtudSearchInterval)
+		return
+	}
+
+	if p.size == 0 {
+		p.size = (p.lo + p.hi + 1) / 2
+	}
+	timeout := time.Duration(2*s.kcp.rx_rto+s.kcp.interval) * time.Millisecond
+	if timeout < pmtudProbeTimeoutMin {
+		timeout = pmtudProbeTimeoutMin
+	} else if timeout > pmtudProbeTimeoutMax {
+		timeout = pmtudProbeTimeoutMax
+	}
+	p.inflight = true
+	p.deadline = now.Add(timeout)
+	s.kcp.mtu_ack = 0
+	s.kcp.probeMtu(p.size - s.headerSize - s.overhead)
+}
+
+// dontFragment sets DF on the packets sent over conn, so the ones larger than
+// the path MTU are dropped instead of fragmented, by the connection itself or
+// the socket under it
+func dontFragment(conn net.PacketConn, enable bool) error {
+	switch c := conn.(type) {
+	case interface{ SetDontFragment(bool) error }:
+		return c.SetDontFragment(enable)
+	case syscall.Conn:
+		return setDontFragment(c, enable)
+	}
+	return errors.New(errInvalidOperation)
+}
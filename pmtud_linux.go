@@ -0,0 +1,32 @@
+package kcp
+
+import "syscall"
+
+// setDontFragment switches the socket of c to probing the path MTU, the
+// kernel then sets DF and sends packets larger than the path MTU it knows
+// instead of fragmenting them, or back to the default discovery
+func setDontFragment(c syscall.Conn, enable bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	mode, mode6 := syscall.IP_PMTUDISC_WANT, syscall.IPV6_PMTUDISC_WANT
+	if enable {
+		mode, mode6 = syscall.IP_PMTUDISC_PROBE, syscall.IPV6_PMTUDISC_PROBE
+	}
+
+	// IPv6 sockets may send IPv4 packets too, the option of the other
+	// family fails on IPv4 sockets
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, mode)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, mode6)
+		if err4 != nil && err6 != nil {
+			serr = err4
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package kcp
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// setDontFragment isn't supported on this platform, probes may be fragmented
+func setDontFragment(c syscall.Conn, enable bool) error {
+	return errors.New(errInvalidOperation)
+}
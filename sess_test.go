@@ -2,13 +2,16 @@ package kcp
 
 import (
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -42,7 +45,7 @@ func dialEcho() (*UDPSession, error) {
 	//block, _ := NewTEABlockCrypt(pass[:16])
 	//block, _ := NewAESBlockCrypt(pass)
 	block, _ := NewSalsa20BlockCrypt(pass)
-	sess, err := DialWithOptions(portEcho, block, 10, 3)
+	sess, err := DialWithOptions("udp", portEcho, block, 10, 3)
 	if err != nil {
 		panic(err)
 	}
@@ -64,7 +67,7 @@ func dialEcho() (*UDPSession, error) {
 }
 
 func dialSink() (*UDPSession, error) {
-	sess, err := DialWithOptions(portSink, nil, 0, 0)
+	sess, err := DialWithOptions("udp", portSink, nil, 0, 0)
 	if err != nil {
 		panic(err)
 	}
@@ -87,7 +90,7 @@ func dialTinyBufferEcho() (*UDPSession, error) {
 	//block, _ := NewTEABlockCrypt(pass[:16])
 	//block, _ := NewAESBlockCrypt(pass)
 	block, _ := NewSalsa20BlockCrypt(pass)
-	sess, err := DialWithOptions(portTinyBufferEcho, block, 10, 3)
+	sess, err := DialWithOptions("udp", portTinyBufferEcho, block, 10, 3)
 	if err != nil {
 		panic(err)
 	}
@@ -101,7 +104,7 @@ func listenEcho() (net.Listener, error) {
 	//block, _ := NewTEABlockCrypt(pass[:16])
 	//block, _ := NewAESBlockCrypt(pass)
 	block, _ := NewSalsa20BlockCrypt(pass)
-	return ListenWithOptions(portEcho, block, 10, 3)
+	return ListenWithOptions("udp", portEcho, block, 10, 3)
 }
 func listenTinyBufferEcho() (net.Listener, error) {
 	//block, _ := NewNoneBlockCrypt(pass)
@@ -109,11 +112,11 @@ func listenTinyBufferEcho() (net.Listener, error) {
 	//block, _ := NewTEABlockCrypt(pass[:16])
 	//block, _ := NewAESBlockCrypt(pass)
 	block, _ := NewSalsa20BlockCrypt(pass)
-	return ListenWithOptions(portTinyBufferEcho, block, 10, 3)
+	return ListenWithOptions("udp", portTinyBufferEcho, block, 10, 3)
 }
 
 func listenSink() (net.Listener, error) {
-	return ListenWithOptions(portSink, nil, 0, 0)
+	return ListenWithOptions("udp", portSink, nil, 0, 0)
 }
 
 func echoServer() {
@@ -194,7 +197,10 @@ func handleEcho(conn *UDPSession) {
 	buf := make([]byte, 65536)
 	for {
 		n, err := conn.Read(buf)
-		if err != nil {
+		if err == io.EOF {
+			conn.Close()
+			return
+		} else if err != nil {
 			panic(err)
 		}
 		conn.Write(buf[:n])
@@ -213,7 +219,10 @@ func handleSink(conn *UDPSession) {
 	buf := make([]byte, 65536)
 	for {
 		_, err := conn.Read(buf)
-		if err != nil {
+		if err == io.EOF {
+			conn.Close()
+			return
+		} else if err != nil {
 			panic(err)
 		}
 	}
@@ -224,7 +233,10 @@ func handleTinyBufferEcho(conn *UDPSession) {
 	buf := make([]byte, 2)
 	for {
 		n, err := conn.Read(buf)
-		if err != nil {
+		if err == io.EOF {
+			conn.Close()
+			return
+		} else if err != nil {
 			panic(err)
 		}
 		conn.Write(buf[:n])
@@ -456,7 +468,7 @@ func TestSNMP(t *testing.T) {
 }
 
 func TestListenerClose(t *testing.T) {
-	l, err := ListenWithOptions(portListerner, nil, 10, 3)
+	l, err := ListenWithOptions("udp", portListerner, nil, 10, 3)
 	if err != nil {
 		t.Fail()
 	}
@@ -470,7 +482,513 @@ func TestListenerClose(t *testing.T) {
 
 	l.Close()
 	fakeaddr, _ := net.ResolveUDPAddr("udp6", "127.0.0.1:1111")
-	if l.closeSession(fakeaddr) {
+	if l.closeSession(sessionKey{fakeaddr.String(), 0}) {
 		t.Fail()
 	}
 }
+
+func TestListenerSessionsPerConv(t *testing.T) {
+	l, err := ListenWithOptions("mem", "memmulti", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// two conversations from the same remote address
+	conn, raddr, err := l.transport.Dial("memmulti")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, conv := range []uint32{1, 2} {
+		kcp := NewKCP(conv, func(buf []byte, size int) {
+			conn.WriteTo(buf[:size], raddr)
+		})
+		kcp.NoDelay(1, 10, 2, 1)
+		kcp.Send([]byte("hello"))
+		kcp.flush(false)
+	}
+
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	s1, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1.GetConv() == s2.GetConv() {
+		t.Fatal("both conversations landed in the same session")
+	}
+	if s1.RemoteAddr().String() == s2.RemoteAddr().String() {
+		t.Fatal("remote addresses should include the conv", s1.RemoteAddr(), s2.RemoteAddr())
+	}
+	s1.Close()
+	s2.Close()
+}
+
+func TestListenerFECMultipleClients(t *testing.T) {
+	l, err := ListenWithOptions("mem", "memfec", nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// each client's packets and parity shard, missing the second data shard
+	type client struct {
+		conn   net.PacketConn
+		raddr  net.Addr
+		shards [][]byte
+	}
+	var clients []*client
+	for conv := uint32(1); conv <= 2; conv++ {
+		conn, raddr, err := l.transport.Dial("memfec")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		c := &client{conn: conn, raddr: raddr}
+		enc := newFECEncoder(3, 1, 0)
+		kcp := NewKCP(conv, func(buf []byte, size int) {
+			shard := make([]byte, fecHeaderSizePlus2+size)
+			copy(shard[fecHeaderSizePlus2:], buf[:size])
+			parity := enc.encode(shard)
+			c.shards = append(c.shards, shard)
+			for _, p := range parity {
+				c.shards = append(c.shards, append([]byte(nil), p...))
+			}
+		})
+		kcp.NoDelay(1, 10, 2, 1)
+		kcp.Syn()
+		for _, msg := range []string{"a", "b", "c"} {
+			kcp.Send([]byte(msg))
+			kcp.flush(false)
+		}
+		if len(c.shards) != 4 {
+			t.Fatal("unexpected number of shards", len(c.shards))
+		}
+		c.shards = append(c.shards[:1], c.shards[2:]...)
+		clients = append(clients, c)
+	}
+
+	// the clients' packets interleave, parity shards follow the other
+	// client's packets
+	for i := 0; i < 3; i++ {
+		for _, c := range clients {
+			c.conn.WriteTo(c.shards[i], c.raddr)
+		}
+	}
+
+	for range clients {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		buf := make([]byte, 64)
+		for _, msg := range []string{"a", "b", "c"} {
+			s.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := s.Read(buf)
+			if err != nil || string(buf[:n]) != msg {
+				t.Fatal(s.GetConv(), "unexpected message", string(buf[:n]), err)
+			}
+		}
+	}
+}
+
+// mtuConn drops the packets larger than the path MTU it simulates
+type mtuConn struct {
+	net.PacketConn
+	mtu int
+}
+
+func (c *mtuConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > c.mtu {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// fragConn models a path MTU the larger packets get through fragmented,
+// unless DF is set
+type fragConn struct {
+	net.PacketConn
+	mtu int
+	df  int32
+}
+
+func (c *fragConn) SetDontFragment(enable bool) error {
+	if enable {
+		atomic.StoreInt32(&c.df, 1)
+	} else {
+		atomic.StoreInt32(&c.df, 0)
+	}
+	return nil
+}
+
+func (c *fragConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > c.mtu && atomic.LoadInt32(&c.df) != 0 {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestPathMTUDiscovery(t *testing.T) {
+	const mtu = 1200
+	paths := map[string]func(net.PacketConn) net.PacketConn{
+		"mempmtud":     func(conn net.PacketConn) net.PacketConn { return &mtuConn{conn, mtu} },
+		"mempmtudfrag": func(conn net.PacketConn) net.PacketConn { return &fragConn{PacketConn: conn, mtu: mtu} },
+	}
+	for name, path := range paths {
+		testPathMTUDiscovery(t, name, mtu, path)
+	}
+}
+
+func testPathMTUDiscovery(t *testing.T, name string, mtu int, path func(net.PacketConn) net.PacketConn) {
+	l, err := ListenWithOptions("mem", name, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		buf := make([]byte, 64)
+		for {
+			if _, err := s.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, raddr, err := l.transport.Dial(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, _ := NewConn(raddr, nil, 10, 3, path(conn))
+	defer cli.Close()
+	defer conn.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetPMTUD(true)
+	cli.Write([]byte("hello"))
+
+	deadline := time.Now().Add(20 * time.Second)
+	for cli.PathMTU() == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if pmtu := cli.PathMTU(); pmtu <= mtu-pmtudPrecision || pmtu > mtu {
+		t.Fatal(name, "unexpected path MTU", pmtu)
+	}
+	cli.mu.Lock()
+	kcpMtu := int(cli.kcp.mtu)
+	cli.mu.Unlock()
+	if kcpMtu != cli.PathMTU()-cli.headerSize {
+		t.Fatal(name, "kcp MTU not adjusted", kcpMtu)
+	}
+}
+
+func TestPacedSession(t *testing.T) {
+	l, err := ListenWithOptions("mem", "mempacing", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// within the peer's initial window, so only pacing holds segments back
+	const size = 32 << 10
+	done := make(chan int, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetWindowSize(128, 128)
+		n := 0
+		buf := make([]byte, 4096)
+		for n < size {
+			m, err := s.Read(buf)
+			if err != nil {
+				break
+			}
+			n += m
+		}
+		done <- n
+	}()
+
+	conn, raddr, err := l.transport.Dial("mempacing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, _ := NewConn(raddr, nil, 0, 0, conn)
+	defer cli.Close()
+	defer conn.Close()
+
+	// a long interval, paced segments must not wait for the next update
+	cli.SetNoDelay(0, 1000, 2, 1)
+	cli.SetWindowSize(128, 128)
+	cli.SetPacing(true, 1<<19)
+	time.Sleep(200 * time.Millisecond) // the next update is scheduled an interval away
+	start := time.Now()
+	cli.Write(make([]byte, size))
+
+	select {
+	case n := <-done:
+		if n != size {
+			t.Fatal("received", n)
+		}
+		if d := time.Since(start); d < 30*time.Millisecond {
+			t.Fatal("not paced", d)
+		}
+	case <-time.After(900 * time.Millisecond):
+		t.Fatal("paced session waited for the update interval")
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	l, err := ListenWithOptions("mem", "memclose", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions("mem", "memclose", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetNoDelay(1, 10, 2, 1)
+
+	// the data written before Close is delivered, then EOF
+	const size = 32 << 10
+	cli.Write(make([]byte, size))
+	cli.Close()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.Copy(ioutil.Discard, s)
+	if err != nil || n != size {
+		t.Fatal("read", n, err)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("read after EOF", err)
+	}
+
+	// writing back after the peer closed, and closing in turn
+	s.Close()
+	for _, sess := range []*UDPSession{cli, s} {
+		select {
+		case <-sess.released:
+		case <-time.After(2 * time.Second):
+			t.Fatal("session still lingering after the close handshake")
+		}
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	l, err := ListenWithOptions("mem", "memreset", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetSynRequired(true)
+
+	cli, err := DialWithOptions("mem", "memreset", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server forgets the session, its next packet gets a reset
+	s.Write([]byte("bye"))
+	time.Sleep(50 * time.Millisecond)
+	s.close(false)
+	<-s.released
+	time.Sleep(50 * time.Millisecond)
+	cli.Write([]byte("hello"))
+	select {
+	case <-cli.die:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reset doesn't close die")
+	}
+
+	// the data received before the reset is still read
+	buf := make([]byte, 64)
+	if n, err := cli.Read(buf); err != nil || string(buf[:n]) != "bye" {
+		t.Fatal("read before reset", n, err)
+	}
+	if _, err := cli.Read(buf); err != ErrConnReset {
+		t.Fatal("read", err)
+	}
+	if _, err := cli.Write([]byte("hello")); err != ErrConnReset {
+		t.Fatal("write", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	conn, raddr, err := newMemTransport().Dial("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newConn(raddr, nil, 0, 0, 0, conn)
+	if err := sess.handshake(200 * time.Millisecond); err == nil {
+		t.Fatal("handshake with nobody succeeded")
+	}
+	sess.close(false)
+
+	// without a timeout, Dial doesn't wait for the server
+	sess, err = DialWithTimeout("mem", "nobody", nil, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.CloseNow()
+	select {
+	case <-sess.released:
+	default:
+		t.Fatal("CloseNow lingers")
+	}
+}
+
+func TestSynRequired(t *testing.T) {
+	l, err := ListenWithOptions("mem", "memsyn", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetSynRequired(true)
+
+	// a client without the handshake gets a reset
+	conn, raddr, err := l.transport.Dial("memsyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	kcp := NewKCP(1, func(buf []byte, size int) {
+		conn.WriteTo(buf[:size], raddr)
+	})
+	kcp.Send([]byte("hello"))
+	kcp.flush(false)
+	buf := make([]byte, mtuLimit)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := conn.ReadFrom(buf); err != nil || !hasCmd(buf[:n], IKCP_CMD_RST, 0) {
+		t.Fatal("no reset", err)
+	}
+	l.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := l.AcceptKCP(); err == nil {
+		t.Fatal("session accepted without a SYN")
+	}
+
+	// resets are rate limited, the monitor is idle so the test can send them
+	for conv := uint32(0); conv < 2*resetRateLimit; conv++ {
+		l.reset(conv, conn.LocalAddr())
+	}
+	resets := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			break
+		}
+		resets++
+	}
+	if resets > resetRateLimit {
+		t.Fatal("resets not rate limited", resets)
+	}
+}
+
+func TestDialWithoutHandshake(t *testing.T) {
+	// a server without the handshake answers the SYN like a window probe,
+	// and drops packets with commands it doesn't know
+	tr := newMemTransport()
+	server, err := tr.Listen("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	chUnknown := make(chan bool, 1)
+	go func() {
+		unknown := false
+		defer func() { chUnknown <- unknown }()
+		buf := make([]byte, mtuLimit)
+		for {
+			n, from, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for data := buf[:n]; len(data) >= IKCP_OVERHEAD; data = data[IKCP_OVERHEAD+binary.LittleEndian.Uint32(data[20:]):] {
+				switch data[4] {
+				case IKCP_CMD_WASK:
+					wins := make([]byte, IKCP_OVERHEAD)
+					(&segment{conv: binary.LittleEndian.Uint32(data), cmd: IKCP_CMD_WINS, wnd: IKCP_WND_RCV}).encode(wins)
+					server.WriteTo(wins, from)
+				case IKCP_CMD_PUSH, IKCP_CMD_ACK, IKCP_CMD_WINS, IKCP_CMD_SACK:
+				default:
+					unknown = true
+				}
+			}
+		}
+	}()
+
+	cli, err := dialWithTransport(tr, "old", nil, 0, 0, dialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+	cli.Close()
+	select {
+	case <-cli.released:
+	case <-time.After(time.Second):
+		t.Fatal("closing lingers for a FIN the server doesn't understand")
+	}
+	server.Close()
+	if <-chUnknown {
+		t.Fatal("server got commands it doesn't know")
+	}
+}
+
+func TestDeadLink(t *testing.T) {
+	conn, raddr, err := newMemTransport().Dial("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newConn(raddr, nil, 0, 0, 0, conn)
+	defer sess.Close()
+	sess.SetNoDelay(1, 10, 2, 1)
+	sess.SetDeadLink(3)
+	deadLinks := atomic.LoadUint64(&DefaultSnmp.DeadLinks)
+
+	// a pending read fails as well as the writes after it
+	chErr := make(chan error, 1)
+	go func() {
+		_, err := sess.Read(make([]byte, 64))
+		chErr <- err
+	}()
+	sess.Write([]byte("hello"))
+	select {
+	case err := <-chErr:
+		if err != ErrDeadLink {
+			t.Fatal("read", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead link undetected")
+	}
+	if _, err := sess.Write([]byte("hello")); err != ErrDeadLink {
+		t.Fatal("write", err)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.DeadLinks) == deadLinks {
+		t.Fatal("dead link uncounted")
+	}
+}
@@ -31,6 +31,10 @@ type Snmp struct {
 	FECErrs          uint64 // incorrect packets recovered from FEC
 	FECParityShards  uint64 // FEC segments received
 	FECShortShards   uint64 // number of data shards that's not enough for recovery
+	ICMPReflected    uint64 // own echo requests reflected back by the peer's host
+	FragReassembled  uint64 // captured IPv4 fragments reassembled into datagrams
+	FragExpired      uint64 // captured IPv4 fragments dropped before their datagram completed
+	DeadLinks        uint64 // sessions closed as a segment reached the retransmission limit
 }
 
 func newSnmp() *Snmp {
@@ -64,6 +68,10 @@ func (s *Snmp) Header() []string {
 		"FECErrs",
 		"FECRecovered",
 		"FECShortShards",
+		"ICMPReflected",
+		"FragReassembled",
+		"FragExpired",
+		"DeadLinks",
 	}
 }
 
@@ -95,6 +103,10 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.FECErrs),
 		fmt.Sprint(snmp.FECRecovered),
 		fmt.Sprint(snmp.FECShortShards),
+		fmt.Sprint(snmp.ICMPReflected),
+		fmt.Sprint(snmp.FragReassembled),
+		fmt.Sprint(snmp.FragExpired),
+		fmt.Sprint(snmp.DeadLinks),
 	}
 }
 
@@ -125,6 +137,10 @@ func (s *Snmp) Copy() *Snmp {
 	d.FECErrs = atomic.LoadUint64(&s.FECErrs)
 	d.FECRecovered = atomic.LoadUint64(&s.FECRecovered)
 	d.FECShortShards = atomic.LoadUint64(&s.FECShortShards)
+	d.ICMPReflected = atomic.LoadUint64(&s.ICMPReflected)
+	d.FragReassembled = atomic.LoadUint64(&s.FragReassembled)
+	d.FragExpired = atomic.LoadUint64(&s.FragExpired)
+	d.DeadLinks = atomic.LoadUint64(&s.DeadLinks)
 	return d
 }
 
@@ -154,6 +170,10 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.FECErrs, 0)
 	atomic.StoreUint64(&s.FECRecovered, 0)
 	atomic.StoreUint64(&s.FECShortShards, 0)
+	atomic.StoreUint64(&s.ICMPReflected, 0)
+	atomic.StoreUint64(&s.FragReassembled, 0)
+	atomic.StoreUint64(&s.FragExpired, 0)
+	atomic.StoreUint64(&s.DeadLinks, 0)
 }
 
 // DefaultSnmp is the global KCP connection statistics collector
@@ -0,0 +1,273 @@
+package kcp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// UDP header size
+	udpHeaderSize = 8
+
+	// packets queued on a mem connection before new ones are dropped
+	memQueueLen = qlen
+)
+
+// Transport creates the packet connections KCP sessions and listeners talk over
+type Transport interface {
+	// Dial returns a packet connection for a client session with raddr,
+	// along with the resolved remote address packets are written to.
+	Dial(raddr string) (net.PacketConn, net.Addr, error)
+
+	// Listen returns a packet connection receiving packets addressed to laddr.
+	Listen(laddr string) (net.PacketConn, error)
+
+	// Overhead returns the number of bytes the transport adds to each packet
+	// exchanged with addr, including the IP header.
+	Overhead(addr net.Addr) int
+}
+
+// the registry of named transports
+var transports = struct {
+	sync.RWMutex
+	m map[string]Transport
+}{m: make(map[string]Transport)}
+
+func init() {
+	RegisterTransport("icmp", new(ICMPTransport))
+	RegisterTransport("udp", new(udpTransport))
+	RegisterTransport("mem", newMemTransport())
+}
+
+// RegisterTransport makes a transport available by name to DialWithOptions and
+// ListenWithOptions, registering an existing name replaces the previous transport.
+func RegisterTransport(name string, t Transport) {
+	transports.Lock()
+	defer transports.Unlock()
+	transports.m[name] = t
+}
+
+// lookupTransport finds a registered transport by name
+func lookupTransport(name string) (Transport, error) {
+	transports.RLock()
+	defer transports.RUnlock()
+	if t, ok := transports.m[name]; ok {
+		return t, nil
+	}
+	return nil, errors.Errorf("kcp: unknown transport %q", name)
+}
+
+// addrIP returns the IP address of addr, nil if it has none
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	case *ICMPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// ipHeaderSize returns the IP header size for packets exchanged with addr
+func ipHeaderSize(addr net.Addr) int {
+	if ip := addrIP(addr); ip != nil && ip.To4() == nil {
+		return ipv6.HeaderLen
+	}
+	return ipv4.HeaderLen
+}
+
+// udpTransport carries KCP packets in UDP datagrams
+type udpTransport struct{}
+
+func (udpTransport) Dial(raddr string) (net.PacketConn, net.Addr, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "net.ResolveUDPAddr")
+	}
+
+	network := "udp4"
+	if udpaddr.IP.To4() == nil {
+		network = "udp"
+	}
+
+	conn, err := net.DialUDP(network, nil, udpaddr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "net.DialUDP")
+	}
+	return &connectedUDPConn{conn}, udpaddr, nil
+}
+
+func (udpTransport) Listen(laddr string) (net.PacketConn, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
+	}
+
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenUDP")
+	}
+	return conn, nil
+}
+
+func (udpTransport) Overhead(addr net.Addr) int { return ipHeaderSize(addr) + udpHeaderSize }
+
+// memTransport delivers packets between connections inside the process,
+// addresses are arbitrary strings, and packets to unknown addresses or full
+// queues are dropped just like on a real network.
+type memTransport struct {
+	mu    sync.Mutex
+	conns map[string]*memConn
+	seq   uint64 // for generating client addresses
+}
+
+func newMemTransport() *memTransport {
+	t := new(memTransport)
+	t.conns = make(map[string]*memConn)
+	return t
+}
+
+func (t *memTransport) Dial(raddr string) (net.PacketConn, net.Addr, error) {
+	laddr := fmt.Sprintf("mem-%d", atomic.AddUint64(&t.seq, 1))
+	conn, err := t.Listen(laddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, memAddr(raddr), nil
+}
+
+func (t *memTransport) Listen(laddr string) (net.PacketConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[laddr]; ok {
+		return nil, errors.Errorf("kcp: mem address %q already in use", laddr)
+	}
+
+	c := new(memConn)
+	c.t = t
+	c.local = memAddr(laddr)
+	c.chPacket = make(chan memPacket, memQueueLen)
+	c.die = make(chan struct{})
+	t.conns[laddr] = c
+	return c, nil
+}
+
+func (t *memTransport) Overhead(addr net.Addr) int { return 0 }
+
+// lookup finds the connection bound to addr
+func (t *memTransport) lookup(addr string) *memConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conns[addr]
+}
+
+// remove unbinds c from its address
+func (t *memTransport) remove(c *memConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[string(c.local)] == c {
+		delete(t.conns, string(c.local))
+	}
+}
+
+// memAddr is the address of a memConn
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type (
+	// memConn is a net.PacketConn on a memTransport
+	memConn struct {
+		t        *memTransport
+		local    memAddr
+		chPacket chan memPacket
+		die      chan struct{}
+		dieOnce  sync.Once
+		rd       atomic.Value // read deadline
+		wd       atomic.Value // write deadline
+	}
+
+	// a packet queued on a memConn
+	memPacket struct {
+		from memAddr
+		data []byte
+	}
+)
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if deadline, ok := c.rd.Load().(time.Time); ok && !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.chPacket:
+		return copy(b, p.data), p.from, nil
+	case <-timeout:
+		return 0, nil, errTimeout{}
+	case <-c.die:
+		return 0, nil, errors.New(errBrokenPipe)
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.die:
+		return 0, errors.New(errBrokenPipe)
+	default:
+	}
+	if deadline, ok := c.wd.Load().(time.Time); ok && !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, errTimeout{}
+	}
+
+	if dst := c.t.lookup(addr.String()); dst != nil {
+		data := make([]byte, len(b))
+		copy(data, b)
+		select {
+		case dst.chPacket <- memPacket{c.local, data}:
+		default: // queue full, drop
+		}
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	err := errors.New(errBrokenPipe)
+	c.dieOnce.Do(func() {
+		close(c.die)
+		c.t.remove(c)
+		err = nil
+	})
+	return err
+}
+
+func (c *memConn) LocalAddr() net.Addr { return c.local }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.rd.Store(t)
+	c.wd.Store(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.rd.Store(t)
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.wd.Store(t)
+	return nil
+}
@@ -0,0 +1,77 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUnknownTransport(t *testing.T) {
+	if _, err := DialWithOptions("nosuchtransport", "127.0.0.1:1", nil, 0, 0); err == nil {
+		t.Fatal("dial on an unknown transport should fail")
+	}
+	if _, err := ListenWithOptions("nosuchtransport", "", nil, 0, 0); err == nil {
+		t.Fatal("listen on an unknown transport should fail")
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	l, err := ListenWithOptions("mem", "memecho", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	cli, err := DialWithOptions("mem", "memecho", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := echo_tester(cli, 1024, 16); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransportOverhead(t *testing.T) {
+	udp4 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	udp6 := &net.UDPAddr{IP: net.ParseIP("::1")}
+	if n := new(udpTransport).Overhead(udp4); n != 28 {
+		t.Fatal("udp4 overhead", n)
+	}
+	if n := new(udpTransport).Overhead(udp6); n != 48 {
+		t.Fatal("udp6 overhead", n)
+	}
+
+	conn, _, err := newMemTransport().Dial("overhead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newConn(udp4, nil, 0, 0, 28, conn)
+	defer sess.Close()
+	if sess.kcp.mtu != IKCP_MTU_DEF-28 {
+		t.Fatal("default mtu does not account for transport overhead", sess.kcp.mtu)
+	}
+	sess.SetMtu(1400)
+	if sess.kcp.mtu != 1400-28 {
+		t.Fatal("SetMtu does not account for transport overhead", sess.kcp.mtu)
+	}
+}
@@ -68,6 +68,18 @@ func (h *updateHeap) removeSession(s *UDPSession) {
 	h.mu.Unlock()
 }
 
+// reschedule moves the next update of s forward to ts, the session's lock
+// must not be held since the updater takes it
+func (h *updateHeap) reschedule(s *UDPSession, ts time.Time) {
+	h.mu.Lock()
+	if s.updaterIdx != -1 && ts.Before(h.entries[s.updaterIdx].ts) {
+		h.entries[s.updaterIdx].ts = ts
+		heap.Fix(h, s.updaterIdx)
+	}
+	h.mu.Unlock()
+	h.wakeup()
+}
+
 func (h *updateHeap) wakeup() {
 	select {
 	case h.chWakeUp <- struct{}{}: